@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// recordFolder returns the folder dedicated to collection/resource, which
+// holds the record file and its attachments. Only layouts that give each
+// record a folder named after it, such as FolderPerRecord, have one.
+func (d *Driver) recordFolder(collection, resource string) (string, bool) {
+	folder := filepath.Join(d.collectionDir(collection), resource)
+	return folder, filepath.Dir(d.recordPath(collection, resource)) == folder
+}
+
+// attachmentPath validates name and returns where the attachment is stored.
+func (d *Driver) attachmentPath(collection, resource, name string) (string, error) {
+	if err := validateName("collection", collection); err != nil {
+		return "", err
+	}
+	if err := validateName("resource", resource); err != nil {
+		return "", err
+	}
+	if err := validateName("attachment", name); err != nil {
+		return "", err
+	}
+	folder, ok := d.recordFolder(collection, resource)
+	if !ok {
+		return "", fmt.Errorf("attachments need a folder-per-record layout, see FolderPerRecord")
+	}
+	path := filepath.Join(folder, name)
+	if path == d.recordPath(collection, resource) || strings.HasSuffix(name, ".tmp") {
+		return "", fmt.Errorf("%w: attachment name %q", ErrReservedName, name)
+	}
+	return path, nil
+}
+
+// WriteAttachment stores the contents of r as the attachment name of an
+// existing record, replacing any previous attachment of that name. It needs
+// a layout that gives each record its own folder, such as FolderPerRecord;
+// attachments are kept in that folder next to the record file and are
+// removed with the record by Delete.
+func (d *Driver) WriteAttachment(collection, resource, name string, r io.Reader) error {
+	collection, resource = d.normalizeNames(collection, resource)
+	if err := d.authorize(OpWrite, collection, resource); err != nil {
+		return err
+	}
+	path, err := d.attachmentPath(collection, resource, name)
+	if err != nil {
+		return err
+	}
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := d.stat(d.recordPath(collection, resource)); os.IsNotExist(err) {
+		return notFound(collection, resource)
+	} else if err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	return nil
+}
+
+// ReadAttachment opens the attachment name of collection/resource. The
+// caller must close it. Missing attachments yield ErrNotFound.
+func (d *Driver) ReadAttachment(collection, resource, name string) (io.ReadCloser, error) {
+	collection, resource = d.normalizeNames(collection, resource)
+	if err := d.authorize(OpRead, collection, resource); err != nil {
+		return nil, err
+	}
+	path, err := d.attachmentPath(collection, resource, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := d.openFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s/%s attachment %s", ErrNotFound, collection, resource, name)
+	}
+	return f, err
+}
+
+// ListAttachments returns the attachment names of collection/resource,
+// sorted.
+func (d *Driver) ListAttachments(collection, resource string) ([]string, error) {
+	collection, resource = d.normalizeNames(collection, resource)
+	if err := validateName("collection", collection); err != nil {
+		return nil, err
+	}
+	if err := validateName("resource", resource); err != nil {
+		return nil, err
+	}
+	if err := d.authorize(OpRead, collection, resource); err != nil {
+		return nil, err
+	}
+	folder, ok := d.recordFolder(collection, resource)
+	if !ok {
+		return nil, nil
+	}
+	entries, err := d.readDir(folder)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := filepath.Base(d.recordPath(collection, resource))
+	var names []string
+	for _, x := range entries {
+		name := x.Name()
+		if x.IsDir() || name == record || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizeDeniesEveryEntryPoint(t *testing.T) {
+	errDenied := errors.New("denied")
+	deny := false
+	var calls []Op
+	d, _ := newTestDriver(t, &Options{
+		IndexKeys:    true,
+		SoftDelete:   true,
+		PathResolver: FolderPerRecord{},
+		Authorize: func(op Op, collection, resource string) error {
+			if deny {
+				calls = append(calls, op)
+				return errDenied
+			}
+			return nil
+		},
+	})
+	if err := d.Write("users", "bob", map[string]string{"name": "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("users", "gone", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("users", "gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteAttachment("users", "bob", "avatar.png", strings.NewReader("png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetCollectionMeta("users", map[string]interface{}{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	var backup bytes.Buffer
+	if err := d.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	// Load the key index so Keys would otherwise be served from memory.
+	if _, err := d.Keys("users"); err != nil {
+		t.Fatal(err)
+	}
+
+	deny = true
+	checks := map[string]func() error{
+		"Keys":       func() error { _, err := d.Keys("users"); return err },
+		"Count":      func() error { _, err := d.Count("users"); return err },
+		"ReadRecent": func() error { _, err := d.ReadRecent("users", 1); return err },
+		"WriteAttachment": func() error {
+			return d.WriteAttachment("users", "bob", "avatar.png", strings.NewReader("x"))
+		},
+		"ReadAttachment": func() error {
+			r, err := d.ReadAttachment("users", "bob", "avatar.png")
+			if err == nil {
+				io.Copy(io.Discard, r)
+				r.Close()
+			}
+			return err
+		},
+		"ListAttachments":   func() error { _, err := d.ListAttachments("users", "bob"); return err },
+		"GetCollectionMeta": func() error { _, err := d.GetCollectionMeta("users"); return err },
+		"SetCollectionMeta": func() error {
+			return d.SetCollectionMeta("users", map[string]interface{}{"v": 2})
+		},
+		"RenameCollection":  func() error { return d.RenameCollection("users", "people") },
+		"CreateCollection":  func() error { return d.CreateCollection("new") },
+		"RestoreCollection": func() error { return d.RestoreCollection("users", bytes.NewReader(backup.Bytes())) },
+		"Backup":            func() error { return d.Backup(io.Discard) },
+		"Undelete":          func() error { return d.Undelete("users", "gone") },
+		"PurgeDeleted":      func() error { _, err := d.PurgeDeleted("users", 0); return err },
+		"Truncate":          func() error { _, err := d.Truncate("users"); return err },
+		"DeleteOlderThan":   func() error { _, err := d.DeleteOlderThan("users", 0); return err },
+	}
+	for name, fn := range checks {
+		calls = nil
+		if err := fn(); !errors.Is(err, errDenied) {
+			t.Errorf("%s = %v, want the Authorize error", name, err)
+		}
+		if len(calls) == 0 {
+			t.Errorf("%s did not consult Authorize", name)
+		}
+	}
+}
+
+func TestAuthorizeErrorFromRecordDeletesIsMatchable(t *testing.T) {
+	errDenied := errors.New("denied")
+	d, _ := newTestDriver(t, &Options{
+		Authorize: func(op Op, collection, resource string) error {
+			// Only the per-record check refuses.
+			if op == OpDelete && resource != "" {
+				return errDenied
+			}
+			return nil
+		},
+	})
+	if err := d.Write("users", "ann", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Truncate("users"); !errors.Is(err, errDenied) {
+		t.Errorf("Truncate = %v, want the Authorize error", err)
+	}
+	if _, err := d.DeleteOlderThan("users", 0); !errors.Is(err, errDenied) {
+		t.Errorf("DeleteOlderThan = %v, want the Authorize error", err)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Backup writes the whole database directory to w as a gzip-compressed tar
+// archive, with entry names relative to the database directory. Every
+// collection is locked, and the write buffer flushed, while the archive is
+// written, so it reflects a single point in time. Temp files are skipped,
+// and records deduplicated by DedupeContent are archived in full.
+func (d *Driver) Backup(w io.Writer) error {
+	collections, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		if err := d.authorize(OpRead, collection, ""); err != nil {
+			return err
+		}
+	}
+	unlock, err := d.lockCollections(collections...)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return d.writeArchive(w, d.dir)
+}
+
+// writeArchive writes the tree under root, which lies inside the database
+// directory, to w in the Backup format. The caller holds the locks.
+//
+// Blob pointers left by DedupeContent are archived as the content they point
+// at, and the blob store itself is left out, so an archive restores on its
+// own even after CollectBlobs has removed blobs it relied on.
+func (d *Driver) writeArchive(w io.Writer, root string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	pointerSize := int64(len(blobMagic) + sha256.Size*2 + 1)
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(d.dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if fi.IsDir() && rel == blobDir {
+			return filepath.SkipDir
+		}
+		if !fi.IsDir() && (!fi.Mode().IsRegular() || strings.HasSuffix(p, ".tmp")) {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if !fi.IsDir() && fi.Size() == pointerSize {
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			if b, err = d.resolveBlob(b); err != nil {
+				return err
+			}
+			hdr.Size = int64(len(b))
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err = tw.Write(b)
+			return err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// autoBackup archives dir, a collection directory or part of one, into
+// Options.AutoBackupDir before it is destroyed. The archive is named after
+// the collection and the current time and is in the Backup format, so
+// RestoreCollection can bring the data back. It is a no-op without
+// AutoBackupDir; the caller holds the collection lock.
+func (d *Driver) autoBackup(collection string, dir string) error {
+	if d.opts.AutoBackupDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(d.opts.AutoBackupDir, 0755); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	name := fmt.Sprintf("%s-%s.tar.gz", d.dirName(collection), time.Now().UTC().Format("20060102T150405.000000000Z"))
+	f, err := ioutil.TempFile(d.opts.AutoBackupDir, name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	defer os.Remove(f.Name())
+	if err := d.writeArchive(f, dir); err != nil {
+		f.Close()
+		return fmt.Errorf("backup of %v failed: %w", collection, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	if err := os.Rename(f.Name(), filepath.Join(d.opts.AutoBackupDir, name)); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	return nil
+}
+
+// RestoreCollection replaces collection with its contents in r, a backup
+// produced by Backup. Entries belonging to other collections are skipped.
+// The collection is extracted next to the live one first and swapped in
+// once the whole archive has been read, so a bad archive leaves it intact.
+// Entries that would land outside the collection are rejected.
+func (d *Driver) RestoreCollection(collection string, r io.Reader) error {
+	collection, _ = d.normalizeNames(collection, "")
+	if err := validateName("collection", collection); err != nil {
+		return err
+	}
+	if err := d.authorize(OpWrite, collection, ""); err != nil {
+		return err
+	}
+	dir := d.collectionDir(collection)
+	prefix, err := filepath.Rel(d.dir, dir)
+	if err != nil {
+		return err
+	}
+	prefix = filepath.ToSlash(prefix) + "/"
+
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	staging, err := ioutil.TempDir(d.dir, ".restore-")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	defer os.RemoveAll(staging)
+	if err := os.Chmod(staging, 0755); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(hdr.Name, prefix) {
+			continue
+		}
+		found = true
+		rel := strings.TrimPrefix(hdr.Name, prefix)
+		for _, part := range strings.Split(rel, "/") {
+			if part == ".." {
+				return fmt.Errorf("backup entry %q escapes collection %s", hdr.Name, collection)
+			}
+		}
+		clean := path.Clean("/" + rel)
+		if clean == "/" {
+			continue
+		}
+		target := filepath.Join(staging, filepath.FromSlash(clean))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("%w: %v", ErrIO, err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("%w: %v", ErrIO, err)
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrIO, err)
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrIO, err)
+			}
+		default:
+			return fmt.Errorf("backup entry %q of collection %s is not a regular file", hdr.Name, collection)
+		}
+	}
+	if !found {
+		return fmt.Errorf("collection %s not found in backup", collection)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	d.index.drop(collection)
+	return d.registerCollection(collection)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With DedupeContent, record files hold a pointer
+//
+//	"GDBBLOB1" | hex SHA-256 of the content | "\n"
+//
+// and the content itself is stored once in .blobs/<hash> at the database root.
+var blobMagic = []byte("GDBBLOB1")
+
+// blobDir is the hidden directory holding deduplicated record contents.
+const blobDir = ".blobs"
+
+func (d *Driver) blobPath(hash string) string {
+	return filepath.Join(d.dir, blobDir, hash)
+}
+
+// storeBlob saves b under its hash, unless an identical blob exists, and
+// returns the pointer to write in its place. The caller must hold
+// d.blobMutex for reading.
+func (d *Driver) storeBlob(b []byte) ([]byte, error) {
+	sum := sha256.Sum256(b)
+	hash := hex.EncodeToString(sum[:])
+	path := d.blobPath(hash)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrIO, err)
+		}
+		// Writers of the same content in other collections may be storing
+		// this blob too, so each uses its own temp file; whichever rename
+		// lands last leaves identical bytes.
+		tempPath, err := writeTemp(context.Background(), path, b, d.opts.Durable)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Rename(tempPath, path); err != nil {
+			os.Remove(tempPath)
+			return nil, fmt.Errorf("%w: %v", ErrIO, err)
+		}
+	}
+	pointer := append([]byte{}, blobMagic...)
+	pointer = append(pointer, hash...)
+	return append(pointer, '\n'), nil
+}
+
+// resolveBlob returns the content a blob pointer refers to. Data that is not
+// a pointer is returned as-is, so records written before DedupeContent was
+// enabled, or after it was disabled, keep working.
+func (d *Driver) resolveBlob(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, blobMagic) {
+		return b, nil
+	}
+	hash := strings.TrimSpace(string(b[len(blobMagic):]))
+	if hash == "" || strings.ContainsAny(hash, "/\\.") {
+		return nil, fmt.Errorf("invalid blob pointer %q", hash)
+	}
+	return ioutil.ReadFile(d.blobPath(hash))
+}
+
+// loadRecord turns the bytes of a record file into the record: blob
+// pointers are resolved, encrypted records are decrypted and the ReadHooks
+// are applied.
+func (d *Driver) loadRecord(collection string, resource string, b []byte) ([]byte, error) {
+	b, err := d.resolveBlob(b)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = d.decryptRecord(collection, resource, b); err != nil {
+		return nil, err
+	}
+	for _, hook := range d.opts.ReadHooks {
+		if b, err = hook(collection, resource, b); err != nil {
+			return nil, err
+		}
+	}
+	if d.opts.RelaxedJSON && d.isJSON(collection) {
+		b = relaxJSON(b)
+	}
+	return b, nil
+}
+
+// CollectBlobs removes the blobs no record file refers to any more and
+// returns how many were removed. Records become unreferenced when they are
+// overwritten or deleted; the space they used is only reclaimed here. Every
+// collection is locked and writes are held back while it runs.
+func (d *Driver) CollectBlobs() (int, error) {
+	collections, err := d.Collections()
+	if err != nil {
+		return 0, err
+	}
+	unlock, err := d.lockCollections(collections...)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	d.blobMutex.Lock()
+	defer d.blobMutex.Unlock()
+
+	// Walk the whole tree rather than the record listings so that pointers
+	// kept by tombstones and custom layouts are found too.
+	referenced := make(map[string]bool)
+	head := make([]byte, len(blobMagic)+sha256.Size*2)
+	err = filepath.Walk(d.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if path == filepath.Join(d.dir, blobDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() || fi.Size() < int64(len(head)) {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.ReadFull(f, head); err != nil {
+			return err
+		}
+		if bytes.HasPrefix(head, blobMagic) {
+			referenced[string(head[len(blobMagic):])] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(d.dir, blobDir))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, x := range entries {
+		if referenced[x.Name()] {
+			continue
+		}
+		if err := os.Remove(d.blobPath(x.Name())); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentIdenticalBlobs(t *testing.T) {
+	d, dir := newTestDriver(t, &Options{DedupeContent: true})
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		collection := fmt.Sprintf("c%d", w)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Every collection stores the same contents in the same order,
+			// so the writers race to create each blob.
+			for i := 0; i < 200; i++ {
+				if err := d.Write(collection, fmt.Sprintf("r%d", i), fmt.Sprintf("content %d", i)); err != nil {
+					t.Errorf("Write: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries, err := os.ReadDir(filepath.Join(dir, blobDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range entries {
+		if strings.HasSuffix(x.Name(), ".tmp") {
+			t.Errorf("leftover temp file %s", x.Name())
+		}
+	}
+	var v string
+	if err := d.Read("c3", "r7", &v); err != nil || v != "content 7" {
+		t.Fatalf("Read = %q, %v", v, err)
+	}
+}
+
+func TestBackupsOutliveCollectedBlobs(t *testing.T) {
+	backups := t.TempDir()
+	d, _ := newTestDriver(t, &Options{DedupeContent: true, AutoBackupDir: backups})
+	if err := d.Write("users", "ann", person{Name: "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	var backup bytes.Buffer
+	if err := d.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	// Dropping the collection archives it, and then nothing refers to the
+	// blob of ann any more.
+	if err := d.Delete("users", ""); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.CollectBlobs(); err != nil || n != 1 {
+		t.Fatalf("CollectBlobs = %d, %v; want 1", n, err)
+	}
+
+	archives, err := filepath.Glob(filepath.Join(backups, "*.tar.gz"))
+	if err != nil || len(archives) != 1 {
+		t.Fatalf("automatic backups = %v, %v; want one", archives, err)
+	}
+	auto, err := os.ReadFile(archives[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, archive := range map[string][]byte{"Backup": backup.Bytes(), "automatic backup": auto} {
+		if err := d.RestoreCollection("users", bytes.NewReader(archive)); err != nil {
+			t.Fatalf("restoring the %s: %v", name, err)
+		}
+		var p person
+		if err := d.Read("users", "ann", &p); err != nil || p.Name != "Ann" {
+			t.Errorf("Read after restoring the %s = %+v, %v; want Ann", name, p, err)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// writeBuffer stages serialized records in memory so bursts of writes can be
+// flushed to disk in one pass. Records staged here are not durable until the
+// next flush. All methods are safe to call on a nil *writeBuffer, which
+// behaves as an empty buffer.
+type writeBuffer struct {
+	d       *Driver
+	mutex   sync.Mutex
+	pending map[string]map[string][]byte
+	count   int
+	limit   int
+	window  time.Duration
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newWriteBuffer(d *Driver, limit int, interval time.Duration, window time.Duration) *writeBuffer {
+	w := &writeBuffer{
+		d:       d,
+		pending: make(map[string]map[string][]byte),
+		limit:   limit,
+		window:  window,
+	}
+	if interval > 0 {
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.loop(interval)
+	}
+	return w
+}
+
+func (w *writeBuffer) loop(interval time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.flush(); err != nil {
+				w.d.log.Error("Unable to flush write buffer: %v\n", err)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// stage records b as the pending value of collection/resource and flushes the
+// buffer once the size threshold is reached. With a debounce window, a record
+// that was not pending yet is flushed on its own once the window expires.
+func (w *writeBuffer) stage(collection string, resource string, b []byte) error {
+	if w.d.closed.Load() {
+		return ErrClosed
+	}
+	if err := validateRecordName(collection, resource); err != nil {
+		return err
+	}
+	if err := w.d.authorize(OpWrite, collection, resource); err != nil {
+		return err
+	}
+	if err := w.d.checkWriteOnce(collection, resource); err != nil {
+		return err
+	}
+	if err := w.d.checkRecordLimit(collection, resource, w.collection(collection)); err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	records, ok := w.pending[collection]
+	if !ok {
+		records = make(map[string][]byte)
+		w.pending[collection] = records
+	}
+	if _, ok := records[resource]; ok && w.d.opts.WriteOnce {
+		w.mutex.Unlock()
+		return fmt.Errorf("%w: %s/%s", ErrImmutable, collection, resource)
+	} else if !ok {
+		w.count++
+		if w.window > 0 {
+			time.AfterFunc(w.window, func() {
+				if err := w.flushResource(collection, resource); err != nil {
+					w.d.log.Error("Unable to flush debounced write of %s/%s: %v\n", collection, resource, err)
+				}
+			})
+		}
+	}
+	records[resource] = b
+	full := w.limit > 0 && w.count >= w.limit
+	w.mutex.Unlock()
+
+	if full {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *writeBuffer) get(collection string, resource string) ([]byte, bool) {
+	if w == nil {
+		return nil, false
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	b, ok := w.pending[collection][resource]
+	return b, ok
+}
+
+// collection returns a copy of the records pending for collection.
+func (w *writeBuffer) collection(collection string) map[string][]byte {
+	if w == nil {
+		return nil
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	records := make(map[string][]byte, len(w.pending[collection]))
+	for resource, b := range w.pending[collection] {
+		records[resource] = b
+	}
+	return records
+}
+
+// discard drops pending records for collection/resource, or for the whole
+// collection when resource is empty. It reports whether anything was dropped.
+func (w *writeBuffer) discard(collection string, resource string) bool {
+	if w == nil {
+		return false
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	records, ok := w.pending[collection]
+	if !ok {
+		return false
+	}
+	if resource == "" {
+		w.count -= len(records)
+		delete(w.pending, collection)
+		return true
+	}
+	if _, ok := records[resource]; !ok {
+		return false
+	}
+	w.count--
+	delete(records, resource)
+	return true
+}
+
+// flush writes every pending record to disk. Records that fail with a
+// filesystem error stay pending; records refused for good are dropped. The
+// first error is returned either way.
+func (w *writeBuffer) flush() error {
+	if w == nil {
+		return nil
+	}
+	w.mutex.Lock()
+	collections := make([]string, 0, len(w.pending))
+	for collection := range w.pending {
+		collections = append(collections, collection)
+	}
+	w.mutex.Unlock()
+
+	var firstErr error
+	for _, collection := range collections {
+		if err := w.flushCollection(collection); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// flushCollection writes the records pending for collection. The caller must
+// not hold the collection mutex.
+//
+// The collection mutex is always taken before w.mutex: operations holding
+// the collection mutex read the buffer, so the opposite order could deadlock.
+// w.mutex itself is only held while copying the records out, so staging and
+// buffered reads are not held up by the disk writes.
+func (w *writeBuffer) flushCollection(collection string) error {
+	if w == nil {
+		return nil
+	}
+	mutex := w.d.getOrCreateMutex(collection)
+	if err := w.d.lock(collection, mutex, false); err != nil {
+		return err
+	}
+	defer mutex.Unlock()
+	return w.write(collection, w.collection(collection))
+}
+
+// flushResource writes the pending value of collection/resource, if any.
+func (w *writeBuffer) flushResource(collection string, resource string) error {
+	if w == nil {
+		return nil
+	}
+	mutex := w.d.getOrCreateMutex(collection)
+	if err := w.d.lock(collection, mutex, false); err != nil {
+		return err
+	}
+	defer mutex.Unlock()
+	b, ok := w.get(collection, resource)
+	if !ok {
+		return nil
+	}
+	return w.write(collection, map[string][]byte{resource: b})
+}
+
+// write stores records in collection and takes every record that was
+// written, or that can never be, out of the buffer. A record refused by the
+// driver's checks (Authorize, WriteOnce, ...) is logged and dropped instead
+// of failing every later flush. The caller holds the collection mutex.
+func (w *writeBuffer) write(collection string, records map[string][]byte) error {
+	var firstErr error
+	for resource, b := range records {
+		if err := w.d.writeRecord(collection, resource, b); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if errors.Is(ioError(err), ErrIO) || errors.Is(err, ErrTimeout) {
+				continue
+			}
+			w.d.log.Error("Dropping buffered write of %s/%s: %v\n", collection, resource, err)
+		}
+		w.remove(collection, resource, b)
+	}
+	return firstErr
+}
+
+// remove drops the pending value of collection/resource if it is still b,
+// that is if it was not staged again while being written.
+func (w *writeBuffer) remove(collection string, resource string, b []byte) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	records := w.pending[collection]
+	if pending, ok := records[resource]; !ok || !bytes.Equal(pending, b) {
+		return
+	}
+	w.count--
+	delete(records, resource)
+	if len(records) == 0 {
+		delete(w.pending, collection)
+	}
+}
+
+// close stops the periodic flusher and flushes what is left.
+func (w *writeBuffer) close() error {
+	if w == nil {
+		return nil
+	}
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+		w.stop = nil
+	}
+	return w.flush()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRefusedBufferedWritesAreDropped(t *testing.T) {
+	errDenied := errors.New("denied")
+	var deny atomic.Bool
+	d, _ := newTestDriver(t, &Options{
+		WriteBufferSize: 100,
+		Authorize: func(op Op, collection, resource string) error {
+			if deny.Load() && op == OpWrite {
+				return errDenied
+			}
+			return nil
+		},
+	})
+	if err := d.Write("users", "ann", person{Name: "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("users", "bob", person{Name: "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Revoking the permission before the flush refuses both records.
+	deny.Store(true)
+	if err := d.Sync(); !errors.Is(err, errDenied) {
+		t.Fatalf("Sync = %v, want the Authorize error", err)
+	}
+	if err := d.Sync(); err != nil {
+		t.Errorf("second Sync = %v; refused records must not stay pending", err)
+	}
+	if n := len(d.buffer.collection("users")); n != 0 {
+		t.Errorf("%d refused records still pending", n)
+	}
+}
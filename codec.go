@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Codec serializes the records of a collection. Extension is the file
+// extension of its records, including the dot (".json", ".yaml").
+//
+// Features that work on the JSON form of a record (MergePatch, Query,
+// RelaxedJSON, TimeLayout, Defaults, HashJSON-based helpers) only apply to
+// collections stored as JSON.
+type Codec interface {
+	Extension() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is the built-in format: tab-indented JSON, or single-line JSON
+// when Compact is set. Records read through it honour StrictDecode and
+// UseNumber.
+type JSONCodec struct {
+	Compact bool
+}
+
+func (JSONCodec) Extension() string {
+	return ".json"
+}
+
+func (c JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	var (
+		b   []byte
+		err error
+	)
+	if c.Compact {
+		b, err = json.Marshal(v)
+	} else {
+		b, err = json.MarshalIndent(v, "", "\t")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(b, byte('\n')), nil
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// SetCollectionCodec stores the records of collection with c instead of
+// Options.Codec. A nil c removes the override. The codec decides the file
+// extension, so records written before the codec changed are no longer
+// found; set it before the collection is first written.
+func (d *Driver) SetCollectionCodec(collection string, c Codec) {
+	collection, _ = d.normalizeNames(collection, "")
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if c == nil {
+		delete(d.codecs, collection)
+		return
+	}
+	if d.codecs == nil {
+		d.codecs = make(map[string]Codec)
+	}
+	d.codecs[collection] = c
+}
+
+// codec returns the codec of collection.
+func (d *Driver) codec(collection string) Codec {
+	d.mutex.Lock()
+	c, ok := d.codecs[collection]
+	d.mutex.Unlock()
+	if ok {
+		return c
+	}
+	if d.opts.Codec != nil {
+		return d.opts.Codec
+	}
+	return JSONCodec{}
+}
+
+// isJSON reports whether the records of collection are stored as JSON.
+func (d *Driver) isJSON(collection string) bool {
+	return d.codec(collection).Extension() == ".json"
+}
+
+// withExtension swaps the ".json" a PathResolver puts on record paths for
+// the extension of the codec of collection.
+func (d *Driver) withExtension(collection string, path string) string {
+	if ext := d.codec(collection).Extension(); ext != ".json" {
+		return strings.TrimSuffix(path, ".json") + ext
+	}
+	return path
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// kvCodec stores flat records as "key=value" lines.
+type kvCodec struct{}
+
+func (kvCodec) Extension() string { return ".kv" }
+
+func (kvCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("kvCodec: unsupported %T", v)
+	}
+	var b bytes.Buffer
+	for k, x := range m {
+		fmt.Fprintf(&b, "%s=%v\n", k, x)
+	}
+	return b.Bytes(), nil
+}
+
+func (kvCodec) Unmarshal(data []byte, v interface{}) error {
+	m := make(map[string]interface{})
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		k, x, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("kvCodec: bad line %q", line)
+		}
+		m[k] = x
+	}
+	p, ok := v.(*interface{})
+	if !ok {
+		return fmt.Errorf("kvCodec: unsupported %T", v)
+	}
+	*p = m
+	return nil
+}
+
+func TestImportUsesCollectionCodec(t *testing.T) {
+	d, dir := newTestDriver(t, nil)
+	d.SetCollectionCodec("users", kvCodec{})
+
+	if err := d.ImportAll(strings.NewReader(`{"users":{"ann":{"name":"Ann"}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "users", "ann.kv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "name=Ann\n" {
+		t.Fatalf("stored %q, want the kv format", b)
+	}
+	if err := d.Verify(); err != nil {
+		t.Fatalf("Verify = %v, want nil for records in the collection's codec", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "users", "bob.kv"), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Verify(); err == nil {
+		t.Fatal("Verify = nil, want a corrupt record reported")
+	}
+}
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifestName is the file at the database root that maps safe directory
+// names back to logical collection names when SafeCollectionNames is set.
+const manifestName = ".collections.json"
+
+// collectionManifest keeps the safe-name -> logical-name mapping in memory
+// and mirrors it to manifestName whenever it changes.
+type collectionManifest struct {
+	mutex sync.Mutex
+	path  string
+	names map[string]string
+}
+
+func loadManifest(dir string) (*collectionManifest, error) {
+	m := &collectionManifest{
+		path:  filepath.Join(dir, manifestName),
+		names: make(map[string]string),
+	}
+	b, err := ioutil.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &m.names); err != nil {
+		return nil, fmt.Errorf("corrupt collection manifest %s: %v", m.path, err)
+	}
+	return m, nil
+}
+
+// reload replaces the in-memory mapping with the one on disk.
+func (m *collectionManifest) reload() error {
+	fresh, err := loadManifest(filepath.Dir(m.path))
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.names = fresh.names
+	return nil
+}
+
+// register records that safe is the directory used by logical and persists
+// the manifest if the mapping is new.
+func (m *collectionManifest) register(safe string, logical string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.names[safe] == logical {
+		return nil
+	}
+	m.names[safe] = logical
+	return m.save()
+}
+
+func (m *collectionManifest) forget(safe string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.names[safe]; !ok {
+		return nil
+	}
+	delete(m.names, safe)
+	return m.save()
+}
+
+func (m *collectionManifest) logical(safe string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if name, ok := m.names[safe]; ok {
+		return name
+	}
+	return safe
+}
+
+func (m *collectionManifest) save() error {
+	b, err := json.MarshalIndent(m.names, "", "\t")
+	if err != nil {
+		return err
+	}
+	tempPath := m.path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, m.path)
+}
+
+// safeName turns a logical collection name into a directory name that is
+// valid on every common filesystem. Names that are already portable are
+// returned unchanged; anything else is slugified and suffixed with a short
+// hash of the original so distinct names never collide.
+func safeName(collection string) string {
+	portable := !strings.HasPrefix(collection, ".")
+	slug := []byte(collection)
+	for i, c := range slug {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			slug[i] = '_'
+			portable = false
+		}
+	}
+	if portable {
+		return collection
+	}
+	sum := sha256.Sum256([]byte(collection))
+	return strings.TrimLeft(string(slug), ".") + "-" + hex.EncodeToString(sum[:4])
+}
+
+// dirName returns the on-disk directory name for collection.
+func (d *Driver) dirName(collection string) string {
+	if d.manifest == nil {
+		return collection
+	}
+	return safeName(collection)
+}
+
+// collectionDir returns the directory holding the records of collection.
+func (d *Driver) collectionDir(collection string) string {
+	return d.opts.PathResolver.CollectionDir(d.dir, d.dirName(collection))
+}
+
+// recordPath returns the file holding collection/resource.
+func (d *Driver) recordPath(collection string, resource string) string {
+	return d.withExtension(collection, d.opts.PathResolver.RecordPath(d.dir, d.dirName(collection), resource))
+}
+
+// registerCollection makes sure a mapped collection name can be resolved back
+// to its logical name. It is a no-op unless SafeCollectionNames is set.
+func (d *Driver) registerCollection(collection string) error {
+	if d.manifest == nil {
+		return nil
+	}
+	if safe := safeName(collection); safe != collection {
+		return d.manifest.register(safe, collection)
+	}
+	return nil
+}
+
+func (d *Driver) forgetCollection(collection string) error {
+	if d.manifest == nil {
+		return nil
+	}
+	return d.manifest.forget(safeName(collection))
+}
+
+// Collections returns the logical names of every collection in the database,
+// sorted. Hidden entries at the root are skipped.
+func (d *Driver) Collections() ([]string, error) {
+	entries, err := d.readDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, x := range entries {
+		if !x.IsDir() || strings.HasPrefix(x.Name(), ".") {
+			continue
+		}
+		name := x.Name()
+		if d.manifest != nil {
+			name = d.manifest.logical(name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// EachCollection calls fn with the logical name of every collection, reading
+// the database directory in batches so memory stays bounded however many
+// collections there are. It stops at, and returns, the first error fn
+// returns. Unlike Collections, names come in directory order, not sorted.
+func (d *Driver) EachCollection(fn func(name string) error) error {
+	f, err := d.openFile(d.dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dir, ok := f.(fs.ReadDirFile)
+	if !ok {
+		return fmt.Errorf("%s is not a directory", d.dir)
+	}
+	for {
+		entries, err := dir.ReadDir(256)
+		for _, x := range entries {
+			if !x.IsDir() || strings.HasPrefix(x.Name(), ".") {
+				continue
+			}
+			name := x.Name()
+			if d.manifest != nil {
+				name = d.manifest.logical(name)
+			}
+			if err := fn(name); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// CollectionsMatching returns the collections whose names match pattern, in
+// the syntax of filepath.Match (for example "logs-2024-*"), sorted. An empty
+// slice is returned when nothing matches; only a malformed pattern is an
+// error.
+func (d *Driver) CollectionsMatching(pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	collections, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+	matches := []string{}
+	for _, name := range collections {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			matches = append(matches, name)
+		}
+	}
+	return matches, nil
+}
+
+// AllKeys returns the resource names of every collection, keyed by
+// collection name. It walks the database directory and then each collection
+// directory, skipping temp, hidden and reserved files, so its cost grows with
+// the size of the whole database; use Keys when one collection will do.
+func (d *Driver) AllKeys() (map[string][]string, error) {
+	collections, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string][]string, len(collections))
+	for _, collection := range collections {
+		names, err := d.recordNames(collection)
+		if err != nil {
+			return nil, err
+		}
+		all[collection] = names
+	}
+	return all, nil
+}
+
+// RenameCollection renames the collection oldName to newName. It fails with
+// ErrCollectionExists if newName is already present. Encrypted records are
+// sealed again for the new name, since the name is part of what their
+// ciphertext authenticates.
+func (d *Driver) RenameCollection(oldName, newName string) error {
+	oldName, _ = d.normalizeNames(oldName, "")
+	newName, _ = d.normalizeNames(newName, "")
+	if err := validateName("collection", oldName); err != nil {
+		return err
+	}
+	if err := validateName("collection", newName); err != nil {
+		return err
+	}
+	if err := d.authorize(OpDelete, oldName, ""); err != nil {
+		return err
+	}
+	if err := d.authorize(OpWrite, newName, ""); err != nil {
+		return err
+	}
+	if oldName == newName {
+		return nil
+	}
+
+	unlock, err := d.lockCollections(oldName, newName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	oldDir, newDir := d.collectionDir(oldName), d.collectionDir(newName)
+	if fi, err := os.Stat(oldDir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("unable to find collection named %v", oldName)
+	}
+	if _, err := os.Stat(newDir); err == nil {
+		return fmt.Errorf("%w: %v", ErrCollectionExists, newName)
+	}
+	defer d.lockBlobs()()
+	resealed, err := d.resealCollection(oldName, newName)
+	if err != nil {
+		return err
+	}
+	if err := d.registerCollection(newName); err != nil {
+		abortReseal(resealed)
+		return err
+	}
+	if err := os.Rename(oldDir, newDir); err != nil {
+		abortReseal(resealed)
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	for _, s := range resealed {
+		path, tempPath := movedPath(oldDir, newDir, s.path), movedPath(oldDir, newDir, s.tempPath)
+		if err := os.Rename(tempPath, path); err != nil {
+			return fmt.Errorf("%w: %v", ErrIO, err)
+		}
+	}
+	if err := d.forgetCollection(oldName); err != nil {
+		return err
+	}
+	d.index.drop(oldName)
+	d.index.drop(newName)
+
+	// Goroutines may already be queued on the old mutex, so it is dropped
+	// rather than moved: newName keeps the mutex we are holding.
+	d.mutex.Lock()
+	delete(d.mutexes, oldName)
+	d.mutex.Unlock()
+	return nil
+}
+
+// movedPath returns where path, inside oldDir, is once oldDir is renamed to
+// newDir.
+func movedPath(oldDir, newDir, path string) string {
+	rel, err := filepath.Rel(oldDir, path)
+	if err != nil {
+		return path
+	}
+	return filepath.Join(newDir, rel)
+}
+
+// CloneCollection copies every record of src into the collection dst, for
+// blue/green migrations. It fails with ErrCollectionExists if dst is already
+// present, unless overwrite is set, in which case the records of dst are
+// removed first so it ends up an exact copy. src is read-locked and dst
+// write-locked for the whole copy, and each record is written the same way
+// Write does (temp file, then rename). Attachments are not copied.
+func (d *Driver) CloneCollection(src, dst string, overwrite bool) error {
+	src, _ = d.normalizeNames(src, "")
+	dst, _ = d.normalizeNames(dst, "")
+	if err := validateName("collection", src); err != nil {
+		return err
+	}
+	if err := validateName("collection", dst); err != nil {
+		return err
+	}
+	if src == dst {
+		return fmt.Errorf("%w: cannot clone %v onto itself", ErrCollectionExists, src)
+	}
+
+	// Same order as lockCollections, so two clones in opposite directions
+	// cannot deadlock.
+	names := []string{src, dst}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := d.buffer.flushCollection(name); err != nil {
+			return err
+		}
+	}
+	for i, name := range names {
+		mutex := d.getOrCreateMutex(name)
+		shared := name == src
+		if err := d.acquire(name, mutex, shared); err != nil {
+			if i > 0 {
+				d.unlock(names[0], names[0] == src)
+			}
+			return err
+		}
+	}
+	defer d.unlock(src, true)
+	defer d.unlock(dst, false)
+
+	files, err := d.recordFiles(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("unable to find collection named %v", src)
+		}
+		return err
+	}
+	if _, err := os.Stat(d.collectionDir(dst)); err == nil {
+		if !overwrite {
+			return fmt.Errorf("%w: %v", ErrCollectionExists, dst)
+		}
+		existing, err := d.recordNames(dst)
+		if err != nil {
+			return err
+		}
+		for _, name := range existing {
+			if err := d.removeRecord(dst, name); err != nil && !os.IsNotExist(err) {
+				return ioError(err)
+			}
+		}
+	}
+	for _, x := range files {
+		b, err := d.readRecord(src, x.name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := d.writeRecord(dst, x.name, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlock releases a lock taken with acquire.
+func (d *Driver) unlock(collection string, shared bool) {
+	mutex := d.getOrCreateMutex(collection)
+	if shared {
+		mutex.RUnlock()
+	} else {
+		mutex.Unlock()
+	}
+}
+
+// CreateCollection creates an empty collection, failing with
+// ErrCollectionExists if it is already present. Write creates collections on
+// demand; this is for provisioning them explicitly.
+func (d *Driver) CreateCollection(collection string) error {
+	collection, _ = d.normalizeNames(collection, "")
+	if err := validateName("collection", collection); err != nil {
+		return err
+	}
+	if err := d.authorize(OpWrite, collection, ""); err != nil {
+		return err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	if err := d.acquire(collection, mutex, false); err != nil {
+		return err
+	}
+	defer mutex.Unlock()
+
+	if err := d.registerCollection(collection); err != nil {
+		return err
+	}
+	if err := os.Mkdir(d.collectionDir(collection), 0755); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%w: %v", ErrCollectionExists, collection)
+		}
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	return nil
+}
+
+// Truncate removes every record of collection, along with leftover temp
+// files, but keeps the collection directory. It returns the number of records
+// removed.
+func (d *Driver) Truncate(collection string) (int, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if err := validateName("collection", collection); err != nil {
+		return 0, err
+	}
+	if d.opts.DenyDeletes {
+		return 0, fmt.Errorf("%w: deletes are disabled", ErrImmutable)
+	}
+	if err := d.authorize(OpDelete, collection, ""); err != nil {
+		return 0, err
+	}
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	files, err := d.recordFiles(collection)
+	if err != nil {
+		return 0, err
+	}
+	if err := d.autoBackup(collection, d.collectionDir(collection)); err != nil {
+		return 0, err
+	}
+	// A truncated collection is known to be empty; after a failure its
+	// entry is rebuilt from the directory instead.
+	truncated := false
+	defer func() {
+		if truncated {
+			d.index.clear(d, collection)
+		} else {
+			d.index.drop(collection)
+		}
+	}()
+	removed := 0
+	for _, x := range files {
+		err := d.removeRecord(collection, x.name)
+		switch {
+		case err == nil:
+			removed++
+		case !os.IsNotExist(err):
+			return removed, ioError(err)
+		}
+	}
+
+	// Temp files left behind by interrupted writes.
+	dir := d.collectionDir(collection)
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && strings.HasSuffix(path, ".tmp") {
+			err = os.Remove(path)
+		}
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return removed, fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	truncated = true
+	return removed, nil
+}
+
+// DeleteOlderThan removes the records of collection whose files were last
+// modified more than age ago and returns how many were removed. It only looks
+// at file metadata, never at record contents, which makes it a cheap
+// retention primitive to run from a periodic goroutine.
+func (d *Driver) DeleteOlderThan(collection string, age time.Duration) (int, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if err := validateName("collection", collection); err != nil {
+		return 0, err
+	}
+	if d.opts.DenyDeletes {
+		return 0, fmt.Errorf("%w: deletes are disabled", ErrImmutable)
+	}
+	if err := d.authorize(OpDelete, collection, ""); err != nil {
+		return 0, err
+	}
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	files, err := d.recordFiles(collection)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-age)
+	removed := 0
+	for _, x := range files {
+		if !x.info.ModTime().Before(cutoff) {
+			continue
+		}
+		err := d.removeRecord(collection, x.name)
+		switch {
+		case err == nil:
+			removed++
+		case !os.IsNotExist(err):
+			return removed, ioError(err)
+		}
+	}
+	return removed, nil
+}
+
+// DropCollection removes collection and all of its records. It is equivalent
+// to Delete(collection, "") but validates the name first.
+func (d *Driver) DropCollection(collection string) error {
+	collection, _ = d.normalizeNames(collection, "")
+	if err := validateName("collection", collection); err != nil {
+		return err
+	}
+	return d.Delete(collection, "")
+}
+
+// collectionMetaFile holds per-collection metadata inside the collection
+// directory. It is never reported as a record.
+const collectionMetaFile = "_meta.json"
+
+// SetCollectionMeta stores meta as the metadata of collection (schema
+// version, creation time, ...), replacing any previous metadata. The
+// collection is created if needed.
+func (d *Driver) SetCollectionMeta(collection string, meta map[string]interface{}) error {
+	collection, _ = d.normalizeNames(collection, "")
+	if err := validateName("collection", collection); err != nil {
+		return err
+	}
+	if err := d.authorize(OpWrite, collection, ""); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMarshal, err)
+	}
+	b = append(b, byte('\n'))
+
+	mutex := d.getOrCreateMutex(collection)
+	if err := d.acquire(collection, mutex, false); err != nil {
+		return err
+	}
+	defer mutex.Unlock()
+
+	if err := d.registerCollection(collection); err != nil {
+		return err
+	}
+	dir := d.collectionDir(collection)
+	path := filepath.Join(dir, collectionMetaFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	return nil
+}
+
+// GetCollectionMeta returns the metadata stored with SetCollectionMeta, or an
+// empty map if none was set.
+func (d *Driver) GetCollectionMeta(collection string) (map[string]interface{}, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if err := validateName("collection", collection); err != nil {
+		return nil, err
+	}
+	if err := d.authorize(OpRead, collection, ""); err != nil {
+		return nil, err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	if err := d.acquire(collection, mutex, true); err != nil {
+		return nil, err
+	}
+	defer mutex.RUnlock()
+
+	meta := make(map[string]interface{})
+	b, err := d.readFile(filepath.Join(d.collectionDir(collection), collectionMetaFile))
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCachedCountAfterTruncate(t *testing.T) {
+	d, _ := newTestDriver(t, &Options{IndexKeys: true})
+	for _, name := range []string{"ann", "bob", "cid"} {
+		if err := d.Write("users", name, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := d.Count("users"); err != nil || n != 3 {
+		t.Fatalf("Count = %d, %v; want 3", n, err)
+	}
+	if n, ok := d.CachedCount("users"); !ok || n != 3 {
+		t.Fatalf("CachedCount = %d, %v; want 3, true", n, ok)
+	}
+	if _, err := d.Truncate("users"); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := d.CachedCount("users"); !ok || n != 0 {
+		t.Fatalf("CachedCount after Truncate = %d, %v; want 0, true", n, ok)
+	}
+	if err := d.Write("users", "dan", 1); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := d.CachedCount("users"); !ok || n != 1 {
+		t.Fatalf("CachedCount after a write = %d, %v; want 1, true", n, ok)
+	}
+}
+
+func TestCachedCountNeedsIndexKeys(t *testing.T) {
+	d, _ := newTestDriver(t, nil)
+	if err := d.Write("users", "ann", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Count("users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.CachedCount("users"); ok {
+		t.Fatal("CachedCount reported a value without IndexKeys")
+	}
+}
+
+func TestFileAtCollectionPath(t *testing.T) {
+	d, dir := newTestDriver(t, nil)
+	if err := os.WriteFile(filepath.Join(dir, "users"), []byte("stray"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("users", "ann", 1); !errors.Is(err, ErrNotCollection) {
+		t.Errorf("Write = %v, want ErrNotCollection", err)
+	}
+	var v int
+	if err := d.Read("users", "ann", &v); !errors.Is(err, ErrNotCollection) {
+		t.Errorf("Read = %v, want ErrNotCollection", err)
+	}
+	if _, err := d.ReadAll("users"); !errors.Is(err, ErrNotCollection) {
+		t.Errorf("ReadAll = %v, want ErrNotCollection", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "users")); err != nil || string(b) != "stray" {
+		t.Errorf("stray file = %q, %v; want it untouched", b, err)
+	}
+}
+
+func TestJSONFileAtRootIsNotACollection(t *testing.T) {
+	d, dir := newTestDriver(t, nil)
+	if err := os.WriteFile(filepath.Join(dir, "orders.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("orders", "o1", 1); err != nil {
+		t.Fatalf("Write next to a root-level orders.json: %v", err)
+	}
+	collections, err := d.Collections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collections) != 1 || collections[0] != "orders" {
+		t.Fatalf("Collections = %v, want [orders]", collections)
+	}
+}
+
+func TestWriteConcurrentWithDropCollection(t *testing.T) {
+	d, dir := newTestDriver(t, &Options{IgnoreMissingOnDelete: true})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if err := d.Write("users", fmt.Sprintf("u%d-%d", w, i%10), i); err != nil {
+					t.Errorf("Write: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if err := d.DropCollection("users"); err != nil {
+				t.Errorf("DropCollection: %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && strings.HasSuffix(path, ".tmp") {
+			t.Errorf("orphaned temp file %s", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("users", "last", 1); err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	if err := d.Read("users", "last", &v); err != nil || v != 1 {
+		t.Fatalf("Read after the stress = %d, %v; want 1", v, err)
+	}
+}
+
+func TestBulkDeletesUnderDenyDeletes(t *testing.T) {
+	backups := t.TempDir()
+	d, _ := newTestDriver(t, &Options{DenyDeletes: true, AutoBackupDir: backups})
+	if err := d.Write("users", "ann", 1); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.Truncate("users"); !errors.Is(err, ErrImmutable) || n != 0 {
+		t.Errorf("Truncate = %d, %v; want 0, ErrImmutable", n, err)
+	}
+	if n, err := d.DeleteOlderThan("users", 0); !errors.Is(err, ErrImmutable) || n != 0 {
+		t.Errorf("DeleteOlderThan = %d, %v; want 0, ErrImmutable", n, err)
+	}
+	if entries, err := os.ReadDir(backups); err != nil || len(entries) != 0 {
+		t.Errorf("refused deletes left backups %v, %v", entries, err)
+	}
+}
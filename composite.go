@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// compositeSeparator joins the parts of a composite key into a resource
+// name. Key parts may not contain it.
+const compositeSeparator = "~"
+
+// CompositeRecord is a record stored under a composite key.
+type CompositeRecord struct {
+	Key   []string
+	Value json.RawMessage
+}
+
+// compositeName validates the parts of key and joins them into a resource
+// name.
+func compositeName(key []string) (string, error) {
+	if len(key) == 0 {
+		return "", fmt.Errorf("%w: empty composite key", ErrInvalidName)
+	}
+	for _, part := range key {
+		if err := validateName("key part", part); err != nil {
+			return "", err
+		}
+		if strings.Contains(part, compositeSeparator) {
+			return "", fmt.Errorf("%w: key part %q contains %q", ErrInvalidName, part, compositeSeparator)
+		}
+	}
+	return strings.Join(key, compositeSeparator), nil
+}
+
+// WriteComposite is Write with the resource named by a composite key such as
+// (tenant, userID). The parts are joined with "~", which they may not
+// contain, and must otherwise be valid resource names.
+func (d *Driver) WriteComposite(collection string, key []string, value interface{}) error {
+	resource, err := compositeName(key)
+	if err != nil {
+		return err
+	}
+	return d.Write(collection, resource, value)
+}
+
+// ReadComposite is Read for a record written by WriteComposite.
+func (d *Driver) ReadComposite(collection string, key []string, value interface{}) error {
+	resource, err := compositeName(key)
+	if err != nil {
+		return err
+	}
+	return d.Read(collection, resource, value)
+}
+
+// DeleteComposite is Delete for a record written by WriteComposite.
+func (d *Driver) DeleteComposite(collection string, key []string) error {
+	resource, err := compositeName(key)
+	if err != nil {
+		return err
+	}
+	return d.Delete(collection, resource)
+}
+
+// ReadAllComposite returns every record of collection with its resource name
+// split back into key parts, in resource-name order. Records written with
+// plain Write come back with a single-part key.
+func (d *Driver) ReadAllComposite(collection string) ([]CompositeRecord, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	names, err := d.recordNames(collection)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]CompositeRecord, 0, len(names))
+	for _, name := range names {
+		b, err := d.readRecord(collection, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, CompositeRecord{
+			Key:   strings.Split(name, compositeSeparator),
+			Value: json.RawMessage(b),
+		})
+	}
+	return records, nil
+}
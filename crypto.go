@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Records encrypted at rest are stored as
+//
+//	"GDBENC2" | keyIDLen (1 byte) | keyID | nonce (12 bytes) | AES-GCM ciphertext
+//
+// AES-GCM is used with the key returned by Options.KeyProvider, which must be
+// 16, 24 or 32 bytes long (AES-128/192/256), and with "collection/resource"
+// as additional data, so a sealed file copied over another record fails to
+// open instead of silently taking its place. The key id is the first four
+// bytes of SHA-256(key), hex encoded; it lets a reader tell which key sealed a
+// record so records written before a key rotation stay readable through
+// Options.KeyLookup. Files without the header are treated as plaintext, so
+// encryption can be turned on for an existing database. Records sealed by
+// earlier versions carry "GDBENC1" and no additional data; they are still
+// read, and sealed in the new format on their next write.
+var (
+	encryptionMagic       = []byte("GDBENC2")
+	legacyEncryptionMagic = []byte("GDBENC1")
+)
+
+// recordAAD is the additional data binding a ciphertext to its record.
+func recordAAD(collection, resource string) []byte {
+	return []byte(collection + "/" + resource)
+}
+
+// ErrDecrypt is returned when an encrypted record cannot be opened, e.g.
+// because its key is unavailable or the data was tampered with.
+var ErrDecrypt = errors.New("unable to decrypt record")
+
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// encryptRecord seals b with the current key of collection, bound to
+// collection/resource. It returns b unchanged when encryption is not
+// configured.
+func (d *Driver) encryptRecord(collection, resource string, b []byte) ([]byte, error) {
+	if d.opts.KeyProvider == nil {
+		return b, nil
+	}
+	key, err := d.opts.KeyProvider(collection)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	id := keyID(key)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(encryptionMagic)+1+len(id)+len(nonce)+len(b)+gcm.Overhead())
+	out = append(out, encryptionMagic...)
+	out = append(out, byte(len(id)))
+	out = append(out, id...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, b, recordAAD(collection, resource)), nil
+}
+
+// decryptRecord opens a record sealed by encryptRecord for
+// collection/resource. Data without the encryption header is returned as-is.
+func (d *Driver) decryptRecord(collection, resource string, b []byte) ([]byte, error) {
+	var aad []byte
+	switch {
+	case bytes.HasPrefix(b, encryptionMagic):
+		aad = recordAAD(collection, resource)
+	case !bytes.HasPrefix(b, legacyEncryptionMagic):
+		return b, nil
+	}
+	if d.opts.KeyProvider == nil {
+		return nil, fmt.Errorf("%w: record is encrypted but no KeyProvider is configured", ErrDecrypt)
+	}
+	rest := b[len(encryptionMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return nil, fmt.Errorf("%w: truncated header", ErrDecrypt)
+	}
+	id := string(rest[1 : 1+int(rest[0])])
+	rest = rest[1+int(rest[0]):]
+
+	key, err := d.opts.KeyProvider(collection)
+	if err != nil {
+		return nil, err
+	}
+	if keyID(key) != id {
+		if d.opts.KeyLookup == nil {
+			return nil, fmt.Errorf("%w: sealed with unknown key %s", ErrDecrypt, id)
+		}
+		if key, err = d.opts.KeyLookup(collection, id); err != nil {
+			return nil, err
+		}
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < gcm.NonceSize() {
+		return nil, fmt.Errorf("%w: truncated nonce", ErrDecrypt)
+	}
+	plain, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecrypt, err)
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// resealedFile is a sealed file of a collection being renamed, encrypted
+// again for the new name into tempPath, next to it.
+type resealedFile struct {
+	path, tempPath string
+}
+
+// resealCollection prepares the rename of the collection oldName to newName
+// when encryption is on. The collection name is part of what every
+// ciphertext authenticates, so each sealed record and tombstone is opened
+// and sealed again for newName into a temp file; the caller moves the temp
+// files into place once the directory is renamed, or removes them. Nothing
+// is staged for plaintext and legacy records, which are not bound to their
+// name. The caller holds the locks of both collections and lockBlobs.
+func (d *Driver) resealCollection(oldName, newName string) ([]resealedFile, error) {
+	if d.opts.KeyProvider == nil {
+		return nil, nil
+	}
+	type target struct {
+		resource, path string
+	}
+	var targets []target
+	files, err := d.recordFiles(oldName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, x := range files {
+		targets = append(targets, target{x.name, x.path})
+	}
+	root := filepath.Join(d.collectionDir(oldName), deletedDir)
+	resources, err := ioutil.ReadDir(root)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, x := range resources {
+		if !x.IsDir() {
+			continue
+		}
+		names, err := tombstones(filepath.Join(root, x.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			targets = append(targets, target{x.Name(), filepath.Join(root, x.Name(), name)})
+		}
+	}
+
+	var staged []resealedFile
+	for _, t := range targets {
+		tempPath, err := d.resealFile(oldName, newName, t.resource, t.path)
+		if err != nil {
+			abortReseal(staged)
+			return nil, fmt.Errorf("resealing %s/%s for %s: %w", oldName, t.resource, newName, err)
+		}
+		if tempPath != "" {
+			staged = append(staged, resealedFile{t.path, tempPath})
+		}
+	}
+	return staged, nil
+}
+
+// resealFile writes the sealed record file path of oldName/resource, sealed
+// again for newName, to a temp file and returns its path, or "" when the file
+// is not bound to its name.
+func (d *Driver) resealFile(oldName, newName, resource, path string) (string, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	b, err := d.resolveBlob(raw)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.HasPrefix(b, encryptionMagic) {
+		return "", nil
+	}
+	if b, err = d.decryptRecord(oldName, resource, b); err != nil {
+		return "", err
+	}
+	if b, err = d.encryptRecord(newName, resource, b); err != nil {
+		return "", err
+	}
+	if bytes.HasPrefix(raw, blobMagic) {
+		if b, err = d.storeBlob(b); err != nil {
+			return "", err
+		}
+	}
+	return writeTemp(context.Background(), path, b, d.opts.Durable)
+}
+
+func abortReseal(staged []resealedFile) {
+	for _, s := range staged {
+		os.Remove(s.tempPath)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func encryptedOptions() *Options {
+	return &Options{KeyProvider: func(string) ([]byte, error) { return testKey, nil }}
+}
+
+func TestSealedRecordIsBoundToItsName(t *testing.T) {
+	d, dir := newTestDriver(t, encryptedOptions())
+	for name, v := range map[string]int{"ann": 1, "bob": 2} {
+		if err := d.Write("users", name, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "users", "ann.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "users", "bob.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	if err := d.Read("users", "bob", &v); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("Read of a record copied from another = %d, %v; want ErrDecrypt", v, err)
+	}
+}
+
+func TestLegacySealedRecordIsReadable(t *testing.T) {
+	d, dir := newTestDriver(t, encryptedOptions())
+	gcm, err := newGCM(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		t.Fatal(err)
+	}
+	id := keyID(testKey)
+	b := append(append(append(append([]byte{}, legacyEncryptionMagic...), byte(len(id))), id...), nonce...)
+	b = gcm.Seal(b, nonce, []byte("7\n"), nil)
+	if err := os.MkdirAll(filepath.Join(dir, "users"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "users", "ann.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	if err := d.Read("users", "ann", &v); err != nil || v != 7 {
+		t.Fatalf("Read of a GDBENC1 record = %d, %v; want 7", v, err)
+	}
+}
+
+func TestRenameEncryptedCollection(t *testing.T) {
+	for _, dedupe := range []bool{false, true} {
+		opts := encryptedOptions()
+		opts.SoftDelete = true
+		opts.DedupeContent = dedupe
+		d, _ := newTestDriver(t, opts)
+		for name, v := range map[string]int{"ann": 1, "bob": 2} {
+			if err := d.Write("users", name, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Delete("users", "bob"); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.RenameCollection("users", "people"); err != nil {
+			t.Fatal(err)
+		}
+		var v int
+		if err := d.Read("people", "ann", &v); err != nil || v != 1 {
+			t.Fatalf("Read after rename (dedupe %v) = %d, %v; want 1", dedupe, v, err)
+		}
+		if err := d.Undelete("people", "bob"); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Read("people", "bob", &v); err != nil || v != 2 {
+			t.Fatalf("Read of an undeleted record after rename (dedupe %v) = %d, %v; want 2", dedupe, v, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Cursor iterates over the records of a collection one at a time. The list of
+// resource names is captured when the cursor is opened; record contents are
+// read lazily as the caller advances, so only one record is held in memory.
+// Records deleted after the cursor was opened are skipped.
+//
+//	cur, err := db.Cursor("users")
+//	...
+//	defer cur.Close()
+//	for cur.Next() {
+//		fmt.Println(cur.Key(), string(cur.Value()))
+//	}
+//	if err := cur.Err(); err != nil { ... }
+type Cursor struct {
+	d          *Driver
+	collection string
+	names      []string
+	pos        int
+	key        string
+	value      []byte
+	err        error
+}
+
+// Cursor opens a cursor over collection.
+func (d *Driver) Cursor(collection string) (*Cursor, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	if err := validateName("collection", collection); err != nil {
+		return nil, err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	if err := d.acquire(collection, mutex, true); err != nil {
+		return nil, err
+	}
+	names, err := d.recordNames(collection)
+	mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return &Cursor{d: d, collection: collection, names: names}, nil
+}
+
+// Next advances to the next record, reporting whether there is one. It
+// returns false at the end of the collection, after Close, or on error.
+func (c *Cursor) Next() bool {
+	c.key, c.value = "", nil
+	for c.err == nil && c.pos < len(c.names) {
+		name := c.names[c.pos]
+		c.pos++
+		b, err := c.d.readRecord(c.collection, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			c.err = err
+			return false
+		}
+		c.key, c.value = name, b
+		return true
+	}
+	return false
+}
+
+// Key returns the resource name of the current record.
+func (c *Cursor) Key() string {
+	return c.key
+}
+
+// Value returns the raw contents of the current record.
+func (c *Cursor) Value() []byte {
+	return c.value
+}
+
+// Err returns the error that stopped iteration, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Close releases the cursor. Further calls to Next return false.
+func (c *Cursor) Close() error {
+	c.names, c.pos = nil, 0
+	c.key, c.value = "", nil
+	return nil
+}
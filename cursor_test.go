@@ -0,0 +1,14 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCursorRejectsParentCollection(t *testing.T) {
+	d, dir := newTestDriver(t, nil)
+	writeSecretOutside(t, dir)
+	if c, err := d.Cursor(".."); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("Cursor(..) = %v, %v; want ErrInvalidName", c, err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Op identifies the kind of operation an Event reports, or that
+// Options.Authorize is asked about. Events are never reported for OpRead.
+type Op int
+
+const (
+	OpWrite Op = iota + 1
+	OpDelete
+	OpRead
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpWrite:
+		return "write"
+	case OpDelete:
+		return "delete"
+	case OpRead:
+		return "read"
+	}
+	return "unknown"
+}
+
+// Event describes a change persisted by the driver. Resource is empty when a
+// whole collection was deleted.
+type Event struct {
+	Op         Op
+	Collection string
+	Resource   string
+	Time       time.Time
+}
+
+// eventBufferSize is the number of undelivered events kept per subscriber.
+const eventBufferSize = 64
+
+type subscriber struct {
+	prefix string
+	ch     chan Event
+}
+
+// eventHub fans events out to subscribers. Publishing never blocks: when a
+// subscriber's buffer is full its oldest pending event is dropped to make
+// room for the new one.
+type eventHub struct {
+	mutex       sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+func (h *eventHub) subscribe(prefix string) (*subscriber, func()) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.subscribers == nil {
+		h.subscribers = make(map[*subscriber]struct{})
+	}
+	sub := &subscriber{prefix: prefix, ch: make(chan Event, eventBufferSize)}
+	h.subscribers[sub] = struct{}{}
+	return sub, func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		if _, ok := h.subscribers[sub]; ok {
+			delete(h.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+func (h *eventHub) publish(e Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for sub := range h.subscribers {
+		if !strings.HasPrefix(e.Collection, sub.prefix) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+			continue
+		default:
+		}
+		select {
+		case <-sub.ch:
+		default:
+		}
+		select {
+		case sub.ch <- e:
+		default:
+		}
+	}
+}
+
+func (d *Driver) emit(op Op, collection, resource string) {
+	d.events.publish(Event{Op: op, Collection: collection, Resource: resource, Time: time.Now()})
+}
+
+// SubscribePrefix returns a channel receiving the events of every collection
+// whose name starts with prefix (all collections for an empty prefix), and a
+// func that cancels the subscription and closes the channel. Events are
+// emitted once a change is on disk, so buffered writes are reported when
+// they are flushed. Each subscriber buffers up to 64 events; a subscriber that
+// falls further behind loses its oldest events rather than blocking writers.
+func (d *Driver) SubscribePrefix(prefix string) (<-chan Event, func()) {
+	sub, cancel := d.events.subscribe(prefix)
+	return sub.ch, cancel
+}
+
+// SubscribeBatches is SubscribePrefix with coalesced delivery, for consumers
+// that would otherwise be flooded by bulk operations such as UpsertMany or
+// Truncate. Events are collected for window after the first one arrives and
+// then delivered together as one slice. Repeated events for the same record
+// within a batch are merged: the latest one is kept, at the position of the
+// latest, so a batch always ends with each record's final state. While the
+// consumer is busy further events keep joining the pending batch, so nothing
+// is dropped for a slow reader beyond what SubscribePrefix would drop.
+// Events still pending when the subscription is cancelled are discarded.
+func (d *Driver) SubscribeBatches(prefix string, window time.Duration) (<-chan []Event, func()) {
+	sub, cancel := d.events.subscribe(prefix)
+	out := make(chan []Event)
+	go func() {
+		defer close(out)
+		type key struct {
+			collection, resource string
+		}
+		var (
+			pending []Event
+			seen    map[key]int
+			timer   <-chan time.Time
+			send    chan<- []Event
+		)
+		for {
+			select {
+			case e, ok := <-sub.ch:
+				if !ok {
+					return
+				}
+				k := key{e.Collection, e.Resource}
+				if i, ok := seen[k]; ok {
+					pending = append(pending[:i], pending[i+1:]...)
+					for j := i; j < len(pending); j++ {
+						seen[key{pending[j].Collection, pending[j].Resource}] = j
+					}
+				}
+				if seen == nil {
+					seen = make(map[key]int)
+				}
+				seen[k] = len(pending)
+				pending = append(pending, e)
+				if timer == nil && send == nil {
+					timer = time.After(window)
+				}
+			case <-timer:
+				timer, send = nil, out
+			case send <- pending:
+				pending, seen, send = nil, nil, nil
+			}
+		}
+	}()
+	return out, cancel
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscribeBatchesKeepsLatestEventLast(t *testing.T) {
+	d, _ := newTestDriver(t, nil)
+	batches, cancel := d.SubscribeBatches("", 50*time.Millisecond)
+	defer cancel()
+
+	d.Write("c", "x", 1)
+	d.Write("c", "y", 1)
+	d.Delete("c", "x")
+	d.Write("c", "x", 2)
+
+	select {
+	case batch := <-batches:
+		want := []struct {
+			op       Op
+			resource string
+		}{{OpWrite, "y"}, {OpWrite, "x"}}
+		if len(batch) != len(want) {
+			t.Fatalf("batch = %+v, want %d events", batch, len(want))
+		}
+		for i, w := range want {
+			if batch[i].Op != w.op || batch[i].Resource != w.resource {
+				t.Fatalf("batch[%d] = %v %s, want %v %s", i, batch[i].Op, batch[i].Resource, w.op, w.resource)
+			}
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no batch delivered")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// ExportAll writes the whole database to w as a single JSON object mapping
+// each collection to an object of its records:
+//
+//	{"collection": {"resource": <record>, ...}, ...}
+//
+// Collections and resources appear in sorted order and records are embedded
+// as-is, compacted, so the output diffs well under version control. Each
+// collection is read-locked while it is exported. It is meant for small
+// databases; ImportAll reads the document back.
+func (d *Driver) ExportAll(w io.Writer) error {
+	collections, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteByte('{')
+	for i, collection := range collections {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		if err := d.exportCollection(bw, collection); err != nil {
+			return err
+		}
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+func (d *Driver) exportCollection(w *bufio.Writer, collection string) error {
+	mutex := d.getOrCreateMutex(collection)
+	if err := d.acquire(collection, mutex, true); err != nil {
+		return err
+	}
+	defer mutex.RUnlock()
+
+	names, err := d.recordNames(collection)
+	if err != nil {
+		return err
+	}
+	key, err := json.Marshal(collection)
+	if err != nil {
+		return err
+	}
+	w.Write(key)
+	w.WriteString(":{")
+	first := true
+	for _, name := range names {
+		b, err := d.readRecord(collection, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var record bytes.Buffer
+		if err := json.Compact(&record, b); err != nil {
+			return fmt.Errorf("record %s/%s is not valid JSON: %v", collection, name, err)
+		}
+		if !first {
+			w.WriteByte(',')
+		}
+		first = false
+		if key, err = json.Marshal(name); err != nil {
+			return err
+		}
+		w.Write(key)
+		w.WriteByte(':')
+		w.Write(record.Bytes())
+	}
+	w.WriteByte('}')
+	return nil
+}
+
+// ImportAll stores every record of a document written by ExportAll. Records
+// with the same name as existing ones overwrite them; records absent from
+// the document are left alone. Each collection is written under its lock.
+func (d *Driver) ImportAll(r io.Reader) error {
+	var doc map[string]map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return fmt.Errorf("invalid export: %v", err)
+	}
+	collections := make([]string, 0, len(doc))
+	for collection := range doc {
+		if err := validateName("collection", collection); err != nil {
+			return err
+		}
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+	for _, collection := range collections {
+		name, _ := d.normalizeNames(collection, "")
+		if err := d.importCollection(name, doc[collection]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Driver) importCollection(collection string, records map[string]json.RawMessage) error {
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, key := range sortedKeys(records) {
+		_, name := d.normalizeNames(collection, key)
+		if err := validateName("resource", name); err != nil {
+			return err
+		}
+		b, err := d.marshalJSON(collection, records[key])
+		if err != nil {
+			return err
+		}
+		if err := d.writeRecord(collection, name, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// ReadFlat reads a record and flattens it into a single-level map keyed by
+// dotted paths, e.g. "Address.City" for a nested field. Array elements are
+// keyed by index ("Tags.0", "Tags.1"), and nested the same way
+// ("Orders.0.ID"). JSON null is kept as a nil value under its key, and empty
+// objects and arrays are kept as-is (an empty map or slice) so they do not
+// disappear. Keys that themselves contain a "." are not escaped, so such
+// paths can be ambiguous. Numbers are float64, or json.Number with UseNumber.
+func (d *Driver) ReadFlat(collection, resource string) (map[string]interface{}, error) {
+	collection, resource = d.normalizeNames(collection, resource)
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	if resource == "" {
+		return nil, fmt.Errorf("Missing resource - unable to read record (no name)")
+	}
+	b, err := d.readRecord(collection, resource)
+	if os.IsNotExist(err) {
+		return nil, notFound(collection, resource)
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc, err := d.decodeMap(b)
+	if err != nil {
+		return nil, fmt.Errorf("record %s/%s: %v", collection, resource, err)
+	}
+	flat := make(map[string]interface{})
+	for key, v := range doc {
+		flatten(flat, key, v)
+	}
+	return flat, nil
+}
+
+func flatten(flat map[string]interface{}, prefix string, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			flat[prefix] = v
+		}
+		for key, child := range v {
+			flatten(flat, prefix+"."+key, child)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			flat[prefix] = v
+		}
+		for i, child := range v {
+			flatten(flat, prefix+"."+strconv.Itoa(i), child)
+		}
+	default:
+		flat[prefix] = v
+	}
+}
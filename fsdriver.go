@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jcelliott/lumber"
+)
+
+// NewFromFS returns a read-only driver over fsys, whose root is laid out like
+// a database directory. It is meant for seeded databases shipped inside the
+// binary with embed.FS. Read, ReadAll, Keys, Count, Exists, Collections and
+// the other plain readers work as usual; every method that modifies the
+// database fails with ErrReadOnly.
+func NewFromFS(fsys fs.FS) (*Driver, error) {
+	opts := Options{
+		Logger:       lumber.NewConsoleLogger((lumber.INFO)),
+		PathResolver: defaultResolver{},
+	}
+	return &Driver{
+		dir:     ".",
+		root:    ".",
+		mutexes: make(map[string]*sync.RWMutex),
+		log:     opts.Logger,
+		opts:    opts,
+		stats:   &lifetimeCounters{},
+		fsys:    fsys,
+	}, nil
+}
+
+// fsPath turns a path built from d.dir into an fs.FS path.
+func fsPath(path string) string {
+	return filepath.ToSlash(filepath.Clean(path))
+}
+
+// readFile reads path from the database directory or, for drivers created
+// by NewFromFS, from the fs.FS.
+func (d *Driver) readFile(path string) ([]byte, error) {
+	if d.fsys != nil {
+		return fs.ReadFile(d.fsys, fsPath(path))
+	}
+	return ioutil.ReadFile(path)
+}
+
+// readDir is ioutil.ReadDir over the database directory or the fs.FS.
+func (d *Driver) readDir(dir string) ([]os.FileInfo, error) {
+	if d.fsys == nil {
+		return ioutil.ReadDir(dir)
+	}
+	entries, err := fs.ReadDir(d.fsys, fsPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, x := range entries {
+		info, err := x.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// openFile is os.Open over the database directory or the fs.FS.
+func (d *Driver) openFile(path string) (fs.File, error) {
+	if d.fsys != nil {
+		return d.fsys.Open(fsPath(path))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// statFile is os.Stat over the database directory or the fs.FS.
+func (d *Driver) statFile(path string) (os.FileInfo, error) {
+	if d.fsys != nil {
+		return fs.Stat(d.fsys, fsPath(path))
+	}
+	return os.Stat(path)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFSDriverReadsFromFS(t *testing.T) {
+	d, err := NewFromFS(fstest.MapFS{
+		"users/ann.json":   {Data: []byte(`{"name":"Ann"}`)},
+		"users/_meta.json": {Data: []byte(`{"version":2}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	if err := d.EachCollection(func(name string) error {
+		names = append(names, name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"users"}) {
+		t.Fatalf("EachCollection visited %v, want [users]", names)
+	}
+
+	meta, err := d.GetCollectionMeta("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta["version"] != float64(2) {
+		t.Fatalf("GetCollectionMeta = %v, want version 2", meta)
+	}
+
+	if err := d.Prefetch("users"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,5 +1,20 @@
 module github.com/dragno99/go-database
 
-go 1.17
+go 1.21
 
-require github.com/jcelliott/lumber v0.0.0-20160324203708-dd349441af25 // indirect
+require (
+	github.com/jcelliott/lumber v0.0.0-20160324203708-dd349441af25
+	github.com/prometheus/client_golang v1.14.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.3.0 // indirect
+	github.com/prometheus/common v0.37.0 // indirect
+	github.com/prometheus/procfs v0.8.0 // indirect
+	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
+	google.golang.org/protobuf v1.28.1 // indirect
+)
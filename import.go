@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ImportNDJSON reads newline-delimited JSON from r and writes every object as a
+// record of collection, keyed by keyFn. Lines are streamed one at a time so
+// memory stays bounded by the longest line. Blank lines are ignored.
+//
+// A line that is not valid JSON or for which keyFn fails aborts the import,
+// unless Options.SkipInvalidImportLines is set, in which case it is logged
+// and skipped. The number of records written is returned either way.
+func (d *Driver) ImportNDJSON(collection string, r io.Reader, keyFn func(json.RawMessage) (string, error)) (int, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return 0, fmt.Errorf("Missing collection - no place to save records")
+	}
+	if keyFn == nil {
+		return 0, fmt.Errorf("Missing key function - unable to name records")
+	}
+
+	// Without a write buffer the whole import runs under a single lock;
+	// otherwise records are staged like any other Write.
+	if d.buffer == nil {
+		mutex := d.getOrCreateMutex(collection)
+		if err := d.acquire(collection, mutex, false); err != nil {
+			return 0, err
+		}
+		defer mutex.Unlock()
+	}
+
+	reader := bufio.NewReader(r)
+	imported := 0
+	for line := 1; ; line++ {
+		raw, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return imported, fmt.Errorf("%w: %v", ErrIO, readErr)
+		}
+		raw = bytes.TrimSpace(raw)
+		if len(raw) > 0 {
+			if err := d.importLine(collection, raw, keyFn); err != nil {
+				if !d.opts.SkipInvalidImportLines {
+					return imported, fmt.Errorf("line %d: %w", line, err)
+				}
+				d.log.Warn("Skipping line %d of import into '%s': %v\n", line, collection, err)
+			} else {
+				imported++
+			}
+		}
+		if readErr == io.EOF {
+			return imported, nil
+		}
+	}
+}
+
+func (d *Driver) importLine(collection string, raw []byte, keyFn func(json.RawMessage) (string, error)) error {
+	if !json.Valid(raw) {
+		return fmt.Errorf("invalid JSON")
+	}
+	resource, err := keyFn(json.RawMessage(raw))
+	if err != nil {
+		return err
+	}
+	_, resource = d.normalizeNames(collection, resource)
+	if err := validateName("resource", resource); err != nil {
+		return err
+	}
+	b, err := d.marshalJSON(collection, raw)
+	if err != nil {
+		return err
+	}
+	if d.buffer != nil {
+		return d.buffer.stage(collection, resource, b)
+	}
+	return d.writeRecord(collection, resource, b)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportNDJSONRejectsTraversalKeys(t *testing.T) {
+	d, dir := newTestDriver(t, nil)
+	keyFn := func(raw json.RawMessage) (string, error) {
+		var doc struct{ ID string }
+		err := json.Unmarshal(raw, &doc)
+		return doc.ID, err
+	}
+	n, err := d.ImportNDJSON("users", strings.NewReader(`{"ID":"../../escaped"}`+"\n"), keyFn)
+	if !errors.Is(err, ErrInvalidName) || n != 0 {
+		t.Fatalf("ImportNDJSON = %d, %v; want 0, ErrInvalidName", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escaped.json")); !os.IsNotExist(err) {
+		t.Fatalf("import wrote outside the database: %v", err)
+	}
+}
+
+func TestImportsApplyDefaultsAndTimeLayout(t *testing.T) {
+	opts := &Options{
+		Defaults:   func(string) map[string]interface{} { return map[string]interface{}{"role": "user"} },
+		TimeLayout: "2006-01-02",
+	}
+	doc := `{"name":"Ann","at":"2024-05-01T10:00:00Z"}`
+	imports := map[string]func(d *Driver) error{
+		"ImportNDJSON": func(d *Driver) error {
+			_, err := d.ImportNDJSON("users", strings.NewReader(doc+"\n"), func(json.RawMessage) (string, error) { return "ann", nil })
+			return err
+		},
+		"ImportAll": func(d *Driver) error {
+			return d.ImportAll(strings.NewReader(`{"users":{"ann":` + doc + `}}`))
+		},
+		"ReadFrom": func(d *Driver) error {
+			_, err := d.Stream("users").ReadFrom(strings.NewReader(`{"key":"ann","value":` + doc + "}\n"))
+			return err
+		},
+	}
+	for name, importFn := range imports {
+		t.Run(name, func(t *testing.T) {
+			d, _ := newTestDriver(t, opts)
+			if err := importFn(d); err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]interface{}
+			if err := d.Read("users", "ann", &got); err != nil {
+				t.Fatal(err)
+			}
+			if got["role"] != "user" || got["at"] != "2024-05-01" || got["name"] != "Ann" {
+				t.Fatalf("imported record = %v, want defaults and TimeLayout applied", got)
+			}
+		})
+	}
+}
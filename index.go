@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// keyIndex caches the resource names of each collection so Keys, Count and
+// Exists do not have to list the directory. An entry is built lazily on first
+// use and kept up to date by this driver's own writes and deletes. Each entry
+// remembers the collection directory's modification time; if the directory
+// changes behind our back (another process, manual edits) the entry is
+// rebuilt on next use. Changes made by another process within the
+// filesystem's mtime granularity can go unnoticed, so with several writer
+// processes the index may briefly be stale.
+//
+// All methods are safe to call on a nil *keyIndex, which caches nothing.
+type keyIndex struct {
+	mutex       sync.Mutex
+	collections map[string]*indexedCollection
+	// changes counts the updates made by this driver, so keys can tell
+	// whether names it loaded without the mutex are still current.
+	changes uint64
+}
+
+type indexedCollection struct {
+	keys    map[string]struct{}
+	modTime time.Time
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{collections: make(map[string]*indexedCollection)}
+}
+
+func dirModTime(dir string) time.Time {
+	if fi, err := os.Stat(dir); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// keys returns the cached names of collection, loading them with load when
+// the entry is missing or the directory changed since it was built.
+//
+// load runs without x.mutex held: it reads the write buffer, whose flushes
+// update the index while holding the buffer's mutex, so calling it under
+// x.mutex could deadlock. The loaded names are only cached if nothing
+// changed in the meantime.
+func (x *keyIndex) keys(d *Driver, collection string, load func() ([]string, error)) ([]string, error) {
+	if x == nil {
+		return load()
+	}
+	modTime := dirModTime(d.collectionDir(collection))
+
+	x.mutex.Lock()
+	entry, ok := x.collections[collection]
+	if !ok {
+		entry, ok = x.loadPersisted(d, collection)
+	}
+	if ok && entry.modTime.Equal(modTime) {
+		names := make([]string, 0, len(entry.keys))
+		for name := range entry.keys {
+			names = append(names, name)
+		}
+		x.mutex.Unlock()
+		sort.Strings(names)
+		return names, nil
+	}
+	changes := x.changes
+	x.mutex.Unlock()
+
+	names, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.changes == changes && dirModTime(d.collectionDir(collection)).Equal(modTime) {
+		entry = &indexedCollection{keys: make(map[string]struct{}, len(names)), modTime: modTime}
+		for _, name := range names {
+			entry.keys[name] = struct{}{}
+		}
+		x.collections[collection] = entry
+	}
+	return names, nil
+}
+
+// contains reports whether resource is indexed. The second result is false
+// when collection has no valid entry and the caller must check the disk.
+func (x *keyIndex) contains(d *Driver, collection, resource string) (bool, bool) {
+	if x == nil {
+		return false, false
+	}
+	modTime := dirModTime(d.collectionDir(collection))
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	entry, ok := x.collections[collection]
+	if !ok {
+		entry, ok = x.loadPersisted(d, collection)
+	}
+	if !ok || !entry.modTime.Equal(modTime) {
+		return false, false
+	}
+	_, found := entry.keys[resource]
+	return found, true
+}
+
+func (x *keyIndex) add(d *Driver, collection, resource string) {
+	x.update(d, collection, func(keys map[string]struct{}) {
+		keys[resource] = struct{}{}
+	})
+}
+
+func (x *keyIndex) remove(d *Driver, collection, resource string) {
+	x.update(d, collection, func(keys map[string]struct{}) {
+		delete(keys, resource)
+	})
+}
+
+// update applies a change made by this driver to an existing entry and
+// records the new directory mtime so the change is not mistaken for an
+// outside one.
+func (x *keyIndex) update(d *Driver, collection string, fn func(map[string]struct{})) {
+	if x == nil {
+		return
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.changes++
+	entry, ok := x.collections[collection]
+	if !ok {
+		return
+	}
+	fn(entry.keys)
+	entry.modTime = dirModTime(d.collectionDir(collection))
+}
+
+// count returns the number of names indexed for collection, without
+// checking the directory.
+func (x *keyIndex) count(collection string) (int, bool) {
+	if x == nil {
+		return 0, false
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	entry, ok := x.collections[collection]
+	if !ok {
+		return 0, false
+	}
+	return len(entry.keys), true
+}
+
+// clear records that collection has just been emptied by this driver.
+func (x *keyIndex) clear(d *Driver, collection string) {
+	if x == nil {
+		return
+	}
+	modTime := dirModTime(d.collectionDir(collection))
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.changes++
+	x.collections[collection] = &indexedCollection{keys: make(map[string]struct{}), modTime: modTime}
+}
+
+// reset forgets every collection.
+func (x *keyIndex) reset() {
+	if x == nil {
+		return
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.changes++
+	x.collections = make(map[string]*indexedCollection)
+}
+
+// drop forgets collection entirely; it is rebuilt on next use.
+func (x *keyIndex) drop(collection string) {
+	if x == nil {
+		return
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.changes++
+	delete(x.collections, collection)
+}
+
+// indexDir holds the entries written by PersistIndexes, one file per
+// collection.
+var indexDir = filepath.Join(metaDir, "index")
+
+type persistedIndex struct {
+	ModTime time.Time `json:"modTime"`
+	Keys    []string  `json:"keys"`
+}
+
+func (d *Driver) indexPath(collection string) string {
+	return filepath.Join(d.dir, indexDir, d.dirName(collection)+".json")
+}
+
+// loadPersisted reads the entry PersistIndexes wrote for collection, if
+// any, and caches it. The caller holds x.mutex and still has to compare the
+// entry's modTime with the directory: a collection changed since the entry
+// was written is rebuilt as usual.
+func (x *keyIndex) loadPersisted(d *Driver, collection string) (*indexedCollection, bool) {
+	b, err := ioutil.ReadFile(d.indexPath(collection))
+	if err != nil {
+		return nil, false
+	}
+	var p persistedIndex
+	if err := json.Unmarshal(b, &p); err != nil {
+		d.log.Warn("Ignoring unreadable index of collection '%s': %v\n", collection, err)
+		return nil, false
+	}
+	entry := &indexedCollection{keys: make(map[string]struct{}, len(p.Keys)), modTime: p.ModTime}
+	for _, name := range p.Keys {
+		entry.keys[name] = struct{}{}
+	}
+	x.collections[collection] = entry
+	return entry, true
+}
+
+// PersistIndexes writes the key index (see Options.IndexKeys) to sidecar
+// files under .meta/index, so the next driver opened on the directory can
+// answer Keys, Count and Exists without listing each collection again.
+// Persisted entries are loaded lazily and discarded when their collection
+// directory was modified after they were written. Only entries that are
+// currently valid are written; call it before Close for a fast restart. It
+// is a no-op without IndexKeys.
+func (d *Driver) PersistIndexes() error {
+	x := d.index
+	if x == nil {
+		return nil
+	}
+	x.mutex.Lock()
+	snapshot := make(map[string]persistedIndex, len(x.collections))
+	for collection, entry := range x.collections {
+		if !entry.modTime.Equal(dirModTime(d.collectionDir(collection))) {
+			continue
+		}
+		keys := make([]string, 0, len(entry.keys))
+		for name := range entry.keys {
+			keys = append(keys, name)
+		}
+		sort.Strings(keys)
+		snapshot[collection] = persistedIndex{ModTime: entry.modTime, Keys: keys}
+	}
+	x.mutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Join(d.dir, indexDir), 0755); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	for collection, p := range snapshot {
+		b, err := json.Marshal(p)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrMarshal, err)
+		}
+		path := d.indexPath(collection)
+		if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+			return fmt.Errorf("%w: %v", ErrIO, err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return fmt.Errorf("%w: %v", ErrIO, err)
+		}
+	}
+	return nil
+}
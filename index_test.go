@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeysConcurrentWithBufferedWrites(t *testing.T) {
+	d, _ := newTestDriver(t, &Options{IndexKeys: true, WriteBufferSize: 1})
+	// Keys may run before the first write lands.
+	if err := d.CreateCollection("users"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		w := w
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if err := d.Write("users", fmt.Sprintf("u%d-%d", w, i), i); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if _, err := d.Keys("users"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Keys and buffered writes deadlocked")
+	}
+	if err := d.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := d.Keys("users")
+	if err != nil || len(keys) != 800 {
+		t.Fatalf("Keys = %d names, %v; want 800", len(keys), err)
+	}
+}
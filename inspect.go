@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HashJSON is the default content hash used by FindDuplicates. It decodes the
+// record and re-encodes it so that whitespace and key order do not matter,
+// then returns the hex SHA-256 of the normalized form. Bytes that are not
+// valid JSON are hashed as-is.
+func HashJSON(data []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err == nil {
+		if normalized, err := json.Marshal(v); err == nil {
+			data = normalized
+		}
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// FindDuplicates groups the records of collection by hashFn(content) and
+// returns the groups holding more than one resource, keyed by hash. A nil
+// hashFn uses HashJSON.
+func (d *Driver) FindDuplicates(collection string, hashFn func(data []byte) string) (map[string][]string, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	if hashFn == nil {
+		hashFn = HashJSON
+	}
+	names, err := d.recordNames(collection)
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]string)
+	for _, name := range names {
+		b, err := d.readRecord(collection, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		hash := hashFn(b)
+		groups[hash] = append(groups[hash], name)
+	}
+	for hash, resources := range groups {
+		if len(resources) < 2 {
+			delete(groups, hash)
+		}
+	}
+	return groups, nil
+}
+
+// CollectionHash returns a hex SHA-256 fingerprint of collection: the name
+// and stored bytes of every record, in sorted key order, are fed into a single
+// hash, so two databases holding byte-identical records produce the same
+// value regardless of directory order. The bytes are hashed as stored (not
+// normalized like HashJSON), so reformatting a record changes the hash. The
+// collection read lock is held while hashing.
+func (d *Driver) CollectionHash(collection string) (string, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return "", fmt.Errorf("Missing collection - unable to read")
+	}
+	mutex := d.getOrCreateMutex(collection)
+	if err := d.acquire(collection, mutex, true); err != nil {
+		return "", err
+	}
+	defer mutex.RUnlock()
+
+	names, err := d.recordNames(collection)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	var size [8]byte
+	for _, name := range names {
+		b, err := d.readRecord(collection, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		// Length prefixes keep ("ab", "c") and ("a", "bc") apart.
+		for _, part := range [][]byte{[]byte(name), b} {
+			binary.BigEndian.PutUint64(size[:], uint64(len(part)))
+			h.Write(size[:])
+			h.Write(part)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DiffCollections compares collection b against collection a by key and
+// content: added lists the resources only in b, removed those only in a and
+// changed those in both whose contents differ. Contents are compared by
+// HashJSON, so formatting and key order do not count as changes. Every list
+// is sorted. To make a target look like a source, pass the target as a.
+func (d *Driver) DiffCollections(a, b string) (added, removed, changed []string, err error) {
+	if a == "" || b == "" {
+		return nil, nil, nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	hashesA, err := d.contentHashes(a)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hashesB, err := d.contentHashes(b)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, name := range sortedKeys(hashesB) {
+		hash, ok := hashesA[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+		case hash != hashesB[name]:
+			changed = append(changed, name)
+		}
+	}
+	for _, name := range sortedKeys(hashesA) {
+		if _, ok := hashesB[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	return added, removed, changed, nil
+}
+
+// contentHashes returns the HashJSON of every record of collection, keyed by
+// resource name. A missing collection has no records.
+func (d *Driver) contentHashes(collection string) (map[string]string, error) {
+	names, err := d.recordNames(collection)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	hashes := make(map[string]string, len(names))
+	for _, name := range names {
+		b, err := d.readRecord(collection, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		hashes[name] = HashJSON(b)
+	}
+	return hashes, nil
+}
+
+// DetectCaseCollisions reports resource names that differ only by case, as
+// such records collapse into one file on case-insensitive filesystems (the
+// macOS and Windows defaults). Each group of colliding names is keyed by
+// "collection/lowercased-name" and sorted. It only reads; resolving the
+// collisions is left to the operator.
+func (d *Driver) DetectCaseCollisions() (map[string][]string, error) {
+	collections, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+	collisions := make(map[string][]string)
+	for _, collection := range collections {
+		names, err := d.recordNames(collection)
+		if err != nil {
+			return nil, err
+		}
+		groups := make(map[string][]string)
+		for _, name := range names {
+			folded := strings.ToLower(name)
+			groups[folded] = append(groups[folded], name)
+		}
+		for folded, group := range groups {
+			if len(group) > 1 {
+				collisions[collection+"/"+folded] = group
+			}
+		}
+	}
+	return collisions, nil
+}
+
+// ModifiedSince returns the resources of collection whose files were modified
+// after since, sorted by name. Records still waiting in the write buffer are
+// always included. It relies on filesystem modification times, whose
+// precision varies (one second or coarser on some filesystems, two seconds
+// on FAT) and which change if files are copied or restored without
+// preserving them, so callers doing incremental sync should allow some overlap.
+func (d *Driver) ModifiedSince(collection string, since time.Time) ([]string, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	if err := validateName("collection", collection); err != nil {
+		return nil, err
+	}
+	pending := d.buffer.collection(collection)
+	files, err := d.recordFiles(collection)
+	if err != nil && !(os.IsNotExist(err) && len(pending) > 0) {
+		return nil, err
+	}
+	var names []string
+	for _, x := range files {
+		if _, ok := pending[x.name]; ok {
+			continue
+		}
+		if x.info.ModTime().After(since) {
+			names = append(names, x.name)
+		}
+	}
+	for name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// RecordSizes returns the size in bytes of every record file of collection,
+// keyed by resource name, from the directory listing alone: no record is
+// read. Sizes are as stored, so they include encryption overhead and, with
+// DedupeContent, only count the blob pointer. Records still waiting in the
+// write buffer report the size of their pending value.
+func (d *Driver) RecordSizes(collection string) (map[string]int64, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	if err := validateName("collection", collection); err != nil {
+		return nil, err
+	}
+	pending := d.buffer.collection(collection)
+	files, err := d.recordFiles(collection)
+	if err != nil && !(os.IsNotExist(err) && len(pending) > 0) {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(files)+len(pending))
+	for _, x := range files {
+		sizes[x.name] = x.info.Size()
+	}
+	for name, b := range pending {
+		sizes[name] = int64(len(b))
+	}
+	return sizes, nil
+}
+
+// defaultSchemaSample is the number of records InferSchema decodes when
+// Options.SchemaSampleSize is not set.
+const defaultSchemaSample = 100
+
+// InferSchema decodes up to Options.SchemaSampleSize records of collection
+// (in resource-name order) and reports the JSON type of each top-level field:
+// "string", "number", "bool", "object", "array" or "null". A field seen with
+// more than one type is reported as "mixed(<type>|<type>...)". A negative
+// sample size scans every record.
+func (d *Driver) InferSchema(collection string) (map[string]string, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	names, err := d.recordNames(collection)
+	if err != nil {
+		return nil, err
+	}
+	limit := d.opts.SchemaSampleSize
+	if limit == 0 {
+		limit = defaultSchemaSample
+	}
+	if limit > 0 && len(names) > limit {
+		names = names[:limit]
+	}
+
+	seen := make(map[string]map[string]bool)
+	for _, name := range names {
+		b, err := d.readRecord(collection, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return nil, fmt.Errorf("record %s/%s is not a JSON object: %v", collection, name, err)
+		}
+		for field, v := range doc {
+			if seen[field] == nil {
+				seen[field] = make(map[string]bool)
+			}
+			seen[field][jsonType(v)] = true
+		}
+	}
+
+	schema := make(map[string]string, len(seen))
+	for field, types := range seen {
+		list := make([]string, 0, len(types))
+		for t := range types {
+			list = append(list, t)
+		}
+		sort.Strings(list)
+		if len(list) == 1 {
+			schema[field] = list[0]
+		} else {
+			schema[field] = "mixed(" + strings.Join(list, "|") + ")"
+		}
+	}
+	return schema, nil
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRecordSizesRejectsParentCollection(t *testing.T) {
+	d, dir := newTestDriver(t, nil)
+	writeSecretOutside(t, dir)
+	if sizes, err := d.RecordSizes(".."); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("RecordSizes(..) = %v, %v; want ErrInvalidName", sizes, err)
+	}
+}
+
+func TestModifiedSinceRejectsParentCollection(t *testing.T) {
+	d, dir := newTestDriver(t, nil)
+	writeSecretOutside(t, dir)
+	if names, err := d.ModifiedSince("..", time.Time{}); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("ModifiedSince(..) = %v, %v; want ErrInvalidName", names, err)
+	}
+}
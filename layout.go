@@ -0,0 +1,39 @@
+package main
+
+import "path/filepath"
+
+// PathResolver decides where collections and records live on disk. dir is the
+// database directory and collection the on-disk collection name (already
+// mapped when SafeCollectionNames is set). RecordPath must return a path
+// inside CollectionDir.
+//
+// The resolver determines how existing files are found, so switching
+// resolvers on an existing database is not migration-safe: records written
+// with one layout are invisible to another.
+type PathResolver interface {
+	CollectionDir(dir, collection string) string
+	RecordPath(dir, collection, resource string) string
+}
+
+// defaultResolver is the standard layout, collection/resource.json.
+type defaultResolver struct{}
+
+func (defaultResolver) CollectionDir(dir, collection string) string {
+	return filepath.Join(dir, collection)
+}
+
+func (r defaultResolver) RecordPath(dir, collection, resource string) string {
+	return filepath.Join(r.CollectionDir(dir, collection), resource+".json")
+}
+
+// FolderPerRecord stores each record as collection/resource/data.json, which
+// leaves room for sidecar files next to the record.
+type FolderPerRecord struct{}
+
+func (FolderPerRecord) CollectionDir(dir, collection string) string {
+	return filepath.Join(dir, collection)
+}
+
+func (r FolderPerRecord) RecordPath(dir, collection, resource string) string {
+	return filepath.Join(r.CollectionDir(dir, collection), resource, "data.json")
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"container/heap"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jcelliott/lumber"
 )
@@ -23,15 +32,289 @@ type (
 		Info(string, ...interface{})
 	}
 	Driver struct {
-		mutex   sync.Mutex
-		mutexes map[string]*sync.Mutex
-		dir     string
-		log     Logger
+		mutex     sync.Mutex
+		mutexes   map[string]*sync.RWMutex
+		dir       string
+		root      string
+		log       Logger
+		opts      Options
+		buffer    *writeBuffer
+		manifest  *collectionManifest
+		stats     *lifetimeCounters
+		types     typeRegistry
+		index     *keyIndex
+		events    eventHub
+		observers opObservers
+		blobMutex sync.RWMutex
+		fsys      fs.FS
+		codecs    map[string]Codec
+		closed    atomic.Bool
 	}
 )
 
+var (
+	// ErrMarshal is returned by Write when the value cannot be encoded as JSON.
+	// It usually indicates a caller bug (channels, functions, cyclic values).
+	ErrMarshal = errors.New("unable to marshal record")
+	// ErrIO is returned when the underlying filesystem operation fails.
+	ErrIO = errors.New("filesystem failure")
+	// ErrNotFound is returned when a record that must exist is missing.
+	ErrNotFound = errors.New("record not found")
+	// ErrAlreadyExists is returned by Create when the record is present.
+	ErrAlreadyExists = errors.New("record already exists")
+	// ErrInvalidName is returned for collection or resource names that are
+	// empty or would escape their directory (path separators, "." or "..").
+	ErrInvalidName = errors.New("invalid name")
+	// ErrCollectionExists is returned when creating a collection that is
+	// already present.
+	ErrCollectionExists = errors.New("collection already exists")
+	// ErrSymlinkEscape is returned when a record or collection is a symlink
+	// pointing outside the database directory and FollowSymlinks is off.
+	ErrSymlinkEscape = errors.New("symlink escapes the database directory")
+	// ErrNotCollection is returned when the path of a collection is taken
+	// by a file, e.g. a stray file named like the collection at the
+	// database root.
+	ErrNotCollection = errors.New("collection path is a file, not a directory")
+	// ErrTimeout is returned when an operation exceeds Options.OpTimeout.
+	ErrTimeout = errors.New("operation timed out")
+	// ErrReservedName is returned for names the driver keeps for its own
+	// files. Collection names starting with "." are reserved for internal
+	// data at the database root (.meta, .collections.json, ...). Resource
+	// names starting with "." are reserved for internal data inside a
+	// collection (.deleted tombstones, ...), and "_meta" holds collection
+	// metadata.
+	ErrReservedName = errors.New("reserved name")
+	// ErrLockTimeout is returned when a collection lock cannot be acquired
+	// within Options.LockTimeout.
+	ErrLockTimeout = errors.New("timed out waiting for collection lock")
+	// ErrReadOnly is returned by the modifying methods of a driver created
+	// by NewFromFS.
+	ErrReadOnly = errors.New("database is read-only")
+	// ErrClosed is returned by operations started after Close.
+	ErrClosed = errors.New("database is closed")
+	// ErrImmutable is returned when WriteOnce forbids overwriting a record or
+	// DenyDeletes forbids removing one.
+	ErrImmutable = errors.New("record is immutable")
+	// ErrTooManyRecords is returned when creating a record would take a
+	// collection past Options.MaxRecordsPerCollection.
+	ErrTooManyRecords = errors.New("too many records in collection")
+)
+
 type Options struct {
 	Logger
+
+	// WriteBufferSize enables buffered writes: Write stages records in memory
+	// and flushes them to disk once this many records are pending. Buffered
+	// records are lost if the process dies before a flush, so this trades
+	// durability for throughput. Zero (the default) writes straight to disk.
+	WriteBufferSize int
+	// WriteBufferInterval flushes the write buffer periodically. It enables
+	// buffering on its own and may be combined with WriteBufferSize.
+	WriteBufferInterval time.Duration
+
+	// SafeCollectionNames stores collections whose names are not portable
+	// (e.g. containing ':' which Windows rejects) under slugified, hashed
+	// directory names. A manifest at the database root maps them back so
+	// Collections still reports the logical names.
+	SafeCollectionNames bool
+
+	// IgnoreMissingOnDelete makes Delete of a record or collection that does
+	// not exist succeed instead of returning an error.
+	IgnoreMissingOnDelete bool
+
+	// SkipInvalidImportLines makes ImportNDJSON log and skip lines that are not
+	// valid JSON or cannot be keyed, instead of aborting the import.
+	SkipInvalidImportLines bool
+
+	// OpTimeout bounds how long Write, Read and Delete may spend on the
+	// filesystem before failing with ErrTimeout, so a hung mount cannot hang
+	// callers. The abandoned work is not cancelled: it finishes (or stays
+	// stuck) in the background. Zero means no timeout.
+	OpTimeout time.Duration
+
+	// StrictDecode makes Read fail when a stored record has fields that the
+	// destination struct does not declare, to catch schema drift early.
+	StrictDecode bool
+
+	// StatsInterval persists the LifetimeStats counters this often, in
+	// addition to on Close. Zero persists them only on Close.
+	StatsInterval time.Duration
+
+	// FollowSymlinks allows records and collections to be symlinks to files
+	// outside the database directory. By default such links are refused with
+	// ErrSymlinkEscape so a stray link cannot expose arbitrary files; links
+	// that stay inside the database are always allowed.
+	FollowSymlinks bool
+
+	// KeyProvider enables encryption at rest. It returns the current key of
+	// a collection and is consulted on every record write and read; see
+	// crypto.go for the on-disk format.
+	KeyProvider func(collection string) ([]byte, error)
+	// KeyLookup returns an older key by id, so records sealed before a key
+	// rotation can still be read. It is only called when the key returned by
+	// KeyProvider does not match the record.
+	KeyLookup func(collection string, keyID string) ([]byte, error)
+
+	// SchemaSampleSize bounds how many records InferSchema decodes. Zero uses
+	// a default of 100; a negative value scans the whole collection.
+	SchemaSampleSize int
+
+	// IndexKeys keeps an in-memory index of resource names per collection so
+	// Keys, Count and Exists avoid listing directories; CachedCount reads it.
+	// See keyIndex for the staleness trade-off when several processes share a
+	// database, and PersistIndexes to carry the index over to the next driver.
+	IndexKeys bool
+
+	// Defaults returns baseline fields for records of a collection. On write,
+	// including the records stored by ImportNDJSON, ImportAll and
+	// CollectionStream.ReadFrom, any top-level key missing from the record is
+	// filled in from it; keys the record already has are never overridden.
+	// Records that are not JSON objects are stored as-is.
+	Defaults func(collection string) map[string]interface{}
+
+	// VerifyOnOpen makes New run Verify and fail if any record file is not
+	// valid JSON, so corruption is caught before serving traffic. It reads
+	// the whole database; bound the cost with VerifySampleSize.
+	VerifyOnOpen bool
+	// VerifySampleSize limits Verify to this many files per collection.
+	// Zero checks every file.
+	VerifySampleSize int
+
+	// TimeLayout, when set, reformats every timestamp in a record with this
+	// time.Format layout before it is stored, imports included, so stored times
+	// are uniform (e.g. "2006-01-02T15:04:05.000Z07:00" for fixed-width,
+	// lexically sortable values). Timestamps are recognised as strings in RFC
+	// 3339 form, which is how encoding/json writes time.Time. Reformatted
+	// records are re-encoded with their object keys sorted. Note that Read can
+	// only decode such values back into time.Time if the layout is RFC 3339
+	// compatible.
+	TimeLayout string
+
+	// PathResolver chooses the on-disk layout of collections and records.
+	// The default is collection/resource.json; see FolderPerRecord for an
+	// alternative. Do not change it for an existing database.
+	PathResolver PathResolver
+
+	// MustExist makes New fail if the database directory does not exist
+	// instead of creating it, so a mistyped path cannot silently start a new,
+	// empty database.
+	MustExist bool
+
+	// Durable fsyncs every record file before it is renamed into place, and
+	// the directory after, so acknowledged writes survive a power loss. It
+	// makes writes noticeably slower.
+	Durable bool
+
+	// SoftDelete makes Delete move records to a tombstone in the collection's
+	// hidden .deleted directory instead of removing them. Tombstoned records
+	// read as missing; see Undelete and PurgeDeleted. Deleting a whole
+	// collection still removes it, tombstones included.
+	SoftDelete bool
+
+	// UseNumber keeps JSON numbers as json.Number instead of float64 when
+	// records are decoded into interface{} values, by Read and by the
+	// map-based paths (Find, MergePatch, AppendToArray, ...), so large
+	// integers such as IDs keep their precision.
+	UseNumber bool
+
+	// DedupeContent stores each distinct record content once, in the hidden
+	// .blobs directory, and makes record files small pointers to it. This
+	// saves space when many records are identical, at the cost of a second
+	// file read per record read and of running CollectBlobs to reclaim the
+	// blobs of overwritten and deleted records. Encrypted records never
+	// share a blob, since every encryption uses a fresh nonce.
+	DedupeContent bool
+
+	// CaseInsensitiveNames lowercases collection and resource names in every
+	// record method (Write, Read, Delete, Exists, Open, Create, Replace, Swap,
+	// WithRecord, MergePatch, AppendToArray, GetOrCreate, WriteIfChanged,
+	// UpsertMany, Undelete and the rest), so "Users" and "users" are the same
+	// collection on every platform. Without it, names are case-sensitive on
+	// Linux but typically not on macOS and Windows, where "Users" and "users"
+	// silently share a directory while keeping separate locks and buffer
+	// entries. Records stored under mixed-case names before enabling it are
+	// not found by the lowercased lookups and must be renamed.
+	CaseInsensitiveNames bool
+
+	// LockTimeout bounds how long an operation waits for a collection lock
+	// before failing with ErrLockTimeout, so a stuck holder (a WithRecord
+	// callback that never returns, say) shows up as errors and a logged
+	// warning rather than as a silent hang. Zero waits forever.
+	LockTimeout time.Duration
+
+	// WriteHooks transform every record, in order, after it is serialized and
+	// before it is written to disk (and before encryption); an error from any
+	// hook aborts the write. Records waiting in the write buffer have not been
+	// through the hooks yet.
+	WriteHooks []func(collection, resource string, data []byte) ([]byte, error)
+	// ReadHooks transform every record read from disk, in order, after
+	// decryption; they are typically the inverse of WriteHooks. An error from
+	// any hook fails the read.
+	ReadHooks []func(collection, resource string, data []byte) ([]byte, error)
+
+	// TransactionLog makes Tx.Commit write its changes to an fsynced
+	// write-ahead log under .meta before applying them, and New finish any
+	// transaction a crash interrupted. Logged records are stored before
+	// WriteHooks and encryption are applied.
+	TransactionLog bool
+
+	// SkipUndecodable makes Query, QueryParallel and CountWhere log and skip
+	// records that cannot be decoded into the requested type instead of
+	// failing.
+	SkipUndecodable bool
+
+	// DebounceWindow coalesces rapid writes to the same record: a write is
+	// held in memory, and served to reads, for up to this long, and only the
+	// latest value written in that time reaches the disk. A hot record is
+	// thus written at most once per window. Pending writes are also flushed
+	// by Sync, FlushResource and Close, but are lost if the process dies
+	// first, so this trades a window of durability for far fewer disk
+	// writes. It uses the write buffer and combines with WriteBufferSize and
+	// WriteBufferInterval.
+	DebounceWindow time.Duration
+
+	// WriteOnce makes records immutable once written: every write to an
+	// existing record, including updates such as MergePatch or Replace,
+	// fails with ErrImmutable. Together with DenyDeletes it turns
+	// collections into append-only logs.
+	WriteOnce bool
+	// DenyDeletes makes Delete, DropCollection, Truncate, DeleteOlderThan
+	// and transaction deletes fail with ErrImmutable.
+	DenyDeletes bool
+
+	// RelaxedJSON accepts hand-edited records on read: // and /* */
+	// comments are stripped and trailing commas are tolerated before the
+	// record is decoded. It only affects reads; records are always written
+	// as strict JSON, so a comment is lost once its record is rewritten.
+	RelaxedJSON bool
+
+	// AutoBackupDir, when set, makes DropCollection, Truncate and deletes
+	// of whole directories first write a tar.gz of the affected data into
+	// this directory, named after the collection and the time, in the
+	// Backup format (see RestoreCollection). If the backup fails, nothing is
+	// deleted.
+	AutoBackupDir string
+
+	// Authorize, when set, is consulted before the filesystem is touched by any
+	// read, write or delete, with the record concerned or, for operations on a
+	// whole collection (listing, ReadAll, DropCollection, Truncate,
+	// DeleteOlderThan, metadata, Backup, RestoreCollection), an empty resource.
+	// Attachments are checked as their record. A non-nil error aborts the
+	// operation and is returned, possibly wrapped (match it with errors.Is). It
+	// may be called more than once per operation, so it should be a pure policy
+	// check.
+	Authorize func(op Op, collection, resource string) error
+
+	// MaxRecordsPerCollection caps the number of records in each collection:
+	// creating a record beyond it fails with ErrTooManyRecords, while writes to
+	// existing records are still allowed. The count comes from the key index,
+	// which this option turns on as if IndexKeys were set, so a write does not
+	// have to list the collection. 0 means no limit.
+	MaxRecordsPerCollection int
+
+	// Codec serializes records; it defaults to JSONCodec{}, tab-indented
+	// JSON. SetCollectionCodec overrides it per collection.
+	Codec Codec
 }
 
 func New(dir string, options *Options) (*Driver, error) {
@@ -43,126 +326,1645 @@ func New(dir string, options *Options) (*Driver, error) {
 	if opts.Logger == nil {
 		opts.Logger = lumber.NewConsoleLogger((lumber.INFO))
 	}
+	if opts.PathResolver == nil {
+		opts.PathResolver = defaultResolver{}
+	}
 
 	driver := Driver{
 		dir:     dir,
-		mutexes: make(map[string]*sync.Mutex),
+		mutexes: make(map[string]*sync.RWMutex),
 		log:     opts.Logger,
+		opts:    opts,
 	}
 	if _, err := os.Stat(dir); err == nil {
 		opts.Logger.Debug("Using '%s' (database already exixts)\n", dir)
-		return &driver, nil
+	} else if opts.MustExist {
+		return nil, fmt.Errorf("database directory '%s' does not exist: %w", dir, err)
+	} else {
+		opts.Logger.Debug("Creating the databse at '%s'...\n", dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return &driver, err
+		}
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return &driver, err
+	}
+	driver.root = root
+	if opts.SafeCollectionNames {
+		manifest, err := loadManifest(dir)
+		if err != nil {
+			return &driver, err
+		}
+		driver.manifest = manifest
+	}
+	stats, err := loadLifetimeCounters(dir)
+	if err != nil {
+		return &driver, err
+	}
+	driver.stats = stats
+	if opts.TransactionLog {
+		if err := driver.replayWAL(); err != nil {
+			return &driver, err
+		}
+	}
+	if opts.VerifyOnOpen {
+		if err := driver.Verify(); err != nil {
+			return &driver, err
+		}
+	}
+	if opts.StatsInterval > 0 {
+		driver.startStatsFlusher(opts.StatsInterval)
 	}
-	opts.Logger.Debug("Creating the databse at '%s'...\n", dir)
-	return &driver, os.MkdirAll(dir, 0755)
+	if opts.IndexKeys || opts.MaxRecordsPerCollection > 0 {
+		driver.index = newKeyIndex()
+	}
+	if opts.WriteBufferSize > 0 || opts.WriteBufferInterval > 0 || opts.DebounceWindow > 0 {
+		driver.buffer = newWriteBuffer(&driver, opts.WriteBufferSize, opts.WriteBufferInterval, opts.DebounceWindow)
+	}
+	return &driver, nil
 }
 
-func stat(path string) (fi os.FileInfo, err error) {
-	if fi, err = os.Stat(path); os.IsNotExist(err) {
-		fi, err = os.Stat(path + ".json")
+// stat is statFile for a path built by recordPath or collectionDir, which
+// already carry the record extension, refusing paths that leave the database
+// through a symlink unless FollowSymlinks is set.
+func (d *Driver) stat(path string) (fi os.FileInfo, err error) {
+	fi, err = d.statFile(path)
+	if err == nil && !d.opts.FollowSymlinks && d.fsys == nil {
+		err = d.checkContained(path)
 	}
 	return
 }
 
-func (d *Driver) Write(collection string, resource string, value interface{}) error {
+// checkWriteTarget applies checkContained to the existing directories a
+// record is about to be written into, so a collection directory that is a
+// symlink out of the database is refused on write as it is on read.
+func (d *Driver) checkWriteTarget(collection string, finalPath string) error {
+	if d.opts.FollowSymlinks {
+		return nil
+	}
+	for _, dir := range []string{d.collectionDir(collection), filepath.Dir(finalPath)} {
+		if _, err := os.Lstat(dir); err != nil {
+			continue
+		}
+		if err := d.checkContained(dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkContained fails with ErrSymlinkEscape if path, once every symlink in it
+// is resolved, lies outside the database directory.
+func (d *Driver) checkContained(path string) error {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	root := d.root
+	d.mutex.Unlock()
+	rel, err := filepath.Rel(root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %v", ErrSymlinkEscape, path)
+	}
+	return nil
+}
+
+func (d *Driver) Write(collection string, resource string, value interface{}) (err error) {
+	collection, resource = d.normalizeNames(collection, resource)
 	if collection == "" {
 		return fmt.Errorf("Missing collection - no place to save records")
 	}
 	if resource == "" {
 		return fmt.Errorf("Missing resource - unable to save records (no name)")
 	}
-	mutex := d.getOrCreateMutex(collection)
-	mutex.Lock()
-	defer mutex.Unlock()
-	dir := filepath.Join(d.dir, collection)
-	finalPath := filepath.Join(dir, resource+".json")
-	tempPath := finalPath + ".tmp"
+	start := time.Now()
+	var b []byte
+	defer func() { d.observers.observe("write", start, len(b), err) }()
 
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	b, err = d.prepareWrite(collection, resource, value)
+	if err != nil {
 		return err
 	}
-	b, err := json.MarshalIndent(value, "", "\t")
+	if d.buffer != nil {
+		if err := d.buffer.stage(collection, resource, b); err != nil {
+			return opError("write", collection, resource, err)
+		}
+		d.index.add(d, collection, resource)
+		return nil
+	}
+
+	return opError("write", collection, resource, d.withTimeout(func() error {
+		mutex := d.getOrCreateMutex(collection)
+		if err := d.acquire(collection, mutex, false); err != nil {
+			return err
+		}
+		defer mutex.Unlock()
+		return d.writeRecord(collection, resource, b)
+	}))
+}
+
+// WriteContext is Write bounded by ctx: the deadline is checked before each
+// filesystem step and, with Durable set, a slow fsync is abandoned when ctx
+// ends (see writeRecordContext). Cancellation is best-effort: it does not
+// interrupt a syscall that has already started, and an abandoned write
+// leaves the previous version of the record in place.
+func (d *Driver) WriteContext(ctx context.Context, collection string, resource string, value interface{}) error {
+	collection, resource = d.normalizeNames(collection, resource)
+	if collection == "" {
+		return fmt.Errorf("Missing collection - no place to save records")
+	}
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to save records (no name)")
+	}
+	b, err := d.prepareWrite(collection, resource, value)
 	if err != nil {
 		return err
 	}
-	b = append(b, byte('\n'))
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d.buffer != nil {
+		if err := d.buffer.stage(collection, resource, b); err != nil {
+			return err
+		}
+		d.index.add(d, collection, resource)
+		return nil
+	}
 
-	if err := ioutil.WriteFile(tempPath, b, 0644); err != nil {
+	mutex := d.getOrCreateMutex(collection)
+	if err := d.acquire(collection, mutex, false); err != nil {
 		return err
 	}
+	defer mutex.Unlock()
+	return d.writeRecordContext(ctx, collection, resource, b)
+}
+
+// TryWrite is Write that does not wait for the collection lock: if another
+// write to the collection is in progress it returns false without writing,
+// so best-effort writers can skip or back off. With the write buffer enabled
+// the record is staged as usual and TryWrite always reports true.
+func (d *Driver) TryWrite(collection string, resource string, value interface{}) (bool, error) {
+	collection, resource = d.normalizeNames(collection, resource)
+	if collection == "" {
+		return false, fmt.Errorf("Missing collection - no place to save records")
+	}
+	if resource == "" {
+		return false, fmt.Errorf("Missing resource - unable to save records (no name)")
+	}
+	b, err := d.prepareWrite(collection, resource, value)
+	if err != nil {
+		return false, err
+	}
+	if d.buffer != nil {
+		if err := d.buffer.stage(collection, resource, b); err != nil {
+			return false, err
+		}
+		d.index.add(d, collection, resource)
+		return true, nil
+	}
 
-	return os.Rename(tempPath, finalPath)
+	if d.fsys != nil {
+		return false, ErrReadOnly
+	}
+	if d.closed.Load() {
+		return false, ErrClosed
+	}
+	mutex := d.getOrCreateMutex(collection)
+	if !mutex.TryLock() {
+		return false, nil
+	}
+	defer mutex.Unlock()
+	return true, d.writeRecord(collection, resource, b)
 }
 
-func (d *Driver) Read(collection string, resource string, value interface{}) error {
+// ValidateWrite reports whether Write would accept value for
+// collection/resource: the names must be valid and value must serialize.
+// Nothing is locked or written, so it is cheap to call ahead of a batch.
+// Conditions that depend on the stored data, such as WriteOnce, are not
+// checked.
+func (d *Driver) ValidateWrite(collection string, resource string, value interface{}) error {
+	collection, resource = d.normalizeNames(collection, resource)
 	if collection == "" {
-		return fmt.Errorf("Missing collection - unable to read")
+		return fmt.Errorf("Missing collection - no place to save records")
 	}
 	if resource == "" {
-		return fmt.Errorf("Missing resource - unable to save record (no name)")
+		return fmt.Errorf("Missing resource - unable to save records (no name)")
 	}
+	_, err := d.prepareWrite(collection, resource, value)
+	return err
+}
 
-	record := filepath.Join(d.dir, collection, resource)
+// prepareWrite does the part of a write that needs no lock: it checks the
+// names and serializes value, so the collection lock is only held for the
+// file operations.
+func (d *Driver) prepareWrite(collection string, resource string, value interface{}) ([]byte, error) {
+	if err := validateRecordName(collection, resource); err != nil {
+		return nil, err
+	}
+	return d.marshalRecord(collection, value)
+}
 
-	if _, err := stat(record); err != nil {
-		return err
+// marshalJSON re-encodes raw, a JSON document read from an import or a
+// stream, the way Write would store it in collection. Numbers are kept
+// exactly as written.
+func (d *Driver) marshalJSON(collection string, raw []byte) ([]byte, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMarshal, err)
+	}
+	return d.marshalRecord(collection, v)
+}
+
+// marshalRecord serializes value as it will be stored in collection.
+func (d *Driver) marshalRecord(collection string, value interface{}) ([]byte, error) {
+	b, err := d.codec(collection).Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMarshal, err)
+	}
+	if !d.isJSON(collection) {
+		return b, nil
+	}
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	if d.opts.TimeLayout != "" {
+		b = formatTimes(b, d.opts.TimeLayout)
+	}
+	if d.opts.Defaults != nil {
+		if b, err = applyDefaults(b, d.opts.Defaults(collection)); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMarshal, err)
+		}
+	}
+	return append(b, byte('\n')), nil
+}
+
+// formatTimes rewrites every string in the JSON document b that holds an
+// RFC 3339 timestamp (the encoding/json format of time.Time) using layout.
+// Documents without timestamps are returned unchanged.
+func formatTimes(b []byte, layout string) []byte {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return b
+	}
+	changed := false
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case string:
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				if f := t.Format(layout); f != v {
+					changed = true
+					return f
+				}
+			}
+		case map[string]interface{}:
+			for key, value := range v {
+				v[key] = walk(value)
+			}
+		case []interface{}:
+			for i, value := range v {
+				v[i] = walk(value)
+			}
+		}
+		return v
+	}
+	doc = walk(doc)
+	if !changed {
+		return b
+	}
+	out, err := json.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return b
+	}
+	return out
+}
+
+// applyDefaults fills in top-level keys of the JSON object b that are missing
+// from defaults. Values already present, even null, win. Records that are not
+// objects, or that already have every default, are returned unchanged.
+func applyDefaults(b []byte, defaults map[string]interface{}) ([]byte, error) {
+	if len(defaults) == 0 {
+		return b, nil
+	}
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil || doc == nil {
+		return b, nil
+	}
+	changed := false
+	for key, value := range defaults {
+		if _, ok := doc[key]; !ok {
+			doc[key] = value
+			changed = true
+		}
 	}
-	b, err := ioutil.ReadFile(record + ".json")
+	if !changed {
+		return b, nil
+	}
+	return json.MarshalIndent(doc, "", "\t")
+}
+
+// writeRecord atomically replaces the record file with b. The caller must
+// hold the collection mutex.
+func (d *Driver) writeRecord(collection string, resource string, b []byte) error {
+	return d.writeRecordContext(context.Background(), collection, resource, b)
+}
+
+// writeRecordContext is writeRecord that checks ctx before every filesystem
+// step. With Durable set, the fsync of the temp file runs in a goroutine so a
+// slow disk cannot hold the caller past its deadline; an abandoned fsync is
+// left to finish in the background and its temp file is removed afterwards.
+func (d *Driver) writeRecordContext(ctx context.Context, collection string, resource string, b []byte) error {
+	defer d.lockBlobs()()
+	staged, err := d.stageRecord(ctx, collection, resource, b)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(b, &value)
+	return d.commitRecord(ctx, staged)
 }
 
-func (d *Driver) ReadAll(collection string) ([]string, error) {
-	if collection == "" {
-		return nil, fmt.Errorf("Missing collection - unable to read")
+// stagedRecord is a record written to its temp file by stageRecord and
+// waiting for commitRecord to rename it into place.
+type stagedRecord struct {
+	collection string
+	resource   string
+	tempPath   string
+	finalPath  string
+}
+
+// abort removes the temp file of a record that will not be committed.
+func (s *stagedRecord) abort() {
+	os.Remove(s.tempPath)
+}
+
+// lockBlobs read-locks the blob store while records are staged and
+// committed, so CollectBlobs cannot remove a blob a record is about to point
+// at. It is a no-op without DedupeContent. Call the returned func to unlock.
+func (d *Driver) lockBlobs() func() {
+	if !d.opts.DedupeContent {
+		return func() {}
 	}
-	dir := filepath.Join(d.dir, collection)
+	d.blobMutex.RLock()
+	return d.blobMutex.RUnlock
+}
 
-	if _, err := stat(dir); err != nil {
+// stageRecord runs every check and transformation of a write and writes the
+// result to a temp file next to the record, leaving the record itself
+// untouched. The caller holds the collection lock and lockBlobs, and must
+// pass the result to commitRecord or abort it.
+func (d *Driver) stageRecord(ctx context.Context, collection string, resource string, b []byte) (*stagedRecord, error) {
+	if err := validateRecordName(collection, resource); err != nil {
+		return nil, err
+	}
+	if err := d.authorize(OpWrite, collection, resource); err != nil {
+		return nil, err
+	}
+	if err := d.checkWriteOnce(collection, resource); err != nil {
+		return nil, err
+	}
+	if err := d.checkRecordLimit(collection, resource, nil); err != nil {
 		return nil, err
 	}
-	file, err := ioutil.ReadDir(dir)
+	if err := d.registerCollection(collection); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	finalPath := d.recordPath(collection, resource)
+
+	for _, hook := range d.opts.WriteHooks {
+		var err error
+		if b, err = hook(collection, resource, b); err != nil {
+			return nil, err
+		}
+	}
+	b, err := d.encryptRecord(collection, resource, b)
 	if err != nil {
 		return nil, err
 	}
-	var records []string
-	for _, x := range file {
-		data, err := ioutil.ReadFile(filepath.Join(dir, x.Name()))
-		if err != nil {
+	if d.opts.DedupeContent {
+		if b, err = d.storeBlob(b); err != nil {
 			return nil, err
 		}
-		records = append(records, string(data))
 	}
-	return records, nil
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := d.checkWriteTarget(collection, finalPath); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(finalPath), 0755); err != nil {
+		if err := d.checkCollectionDir(collection); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tempPath, err := writeTemp(ctx, finalPath, b, d.opts.Durable)
+	if err != nil {
+		return nil, err
+	}
+	return &stagedRecord{collection, resource, tempPath, finalPath}, nil
 }
 
-func (d *Driver) Delete(collection string, resource string) error {
-	path := filepath.Join(collection, resource)
+// commitRecord renames a staged record into place.
+func (d *Driver) commitRecord(ctx context.Context, s *stagedRecord) error {
+	if err := ctx.Err(); err != nil {
+		s.abort()
+		return err
+	}
+	if err := os.Rename(s.tempPath, s.finalPath); err != nil {
+		s.abort()
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	if d.opts.Durable {
+		// Persist the rename itself; failures here are not fatal since the
+		// record is already in place.
+		if dir, err := os.Open(filepath.Dir(s.finalPath)); err == nil {
+			dir.Sync()
+			dir.Close()
+		}
+	}
+	atomic.AddUint64(&d.stats.writes, 1)
+	d.index.add(d, s.collection, s.resource)
+	d.emit(OpWrite, s.collection, s.resource)
+	return nil
+}
+
+// writeTemp writes b to a new, uniquely named temp file next to finalPath
+// and returns its path, for the caller to rename into place. Every write gets
+// its own file, so concurrent writers, or an fsync abandoned in the
+// background, never touch each other's temp files. With durable set the file
+// is fsynced, giving up with ctx.Err() if ctx is done first; the temp file of
+// an abandoned fsync is removed once the fsync returns.
+func writeTemp(ctx context.Context, finalPath string, b []byte, durable bool) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(finalPath), filepath.Base(finalPath)+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	path := f.Name()
+	fail := func(err error) (string, error) {
+		f.Close()
+		os.Remove(path)
+		return "", fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	if err := f.Chmod(0644); err != nil {
+		return fail(err)
+	}
+	if _, err := f.Write(b); err != nil {
+		return fail(err)
+	}
+	if !durable {
+		if err := f.Close(); err != nil {
+			os.Remove(path)
+			return "", fmt.Errorf("%w: %v", ErrIO, err)
+		}
+		return path, nil
+	}
+
+	// Whichever of the fsync and the caller gives up last removes the file
+	// of an abandoned write.
+	var (
+		mutex               sync.Mutex
+		finished, abandoned bool
+	)
+	done := make(chan error, 1)
+	go func() {
+		err := f.Sync()
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		mutex.Lock()
+		finished = true
+		if abandoned {
+			os.Remove(path)
+		}
+		mutex.Unlock()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			os.Remove(path)
+			return "", fmt.Errorf("%w: %v", ErrIO, err)
+		}
+		return path, nil
+	case <-ctx.Done():
+		mutex.Lock()
+		abandoned = true
+		if finished {
+			os.Remove(path)
+		}
+		mutex.Unlock()
+		return "", ctx.Err()
+	}
+}
+
+func (d *Driver) Read(collection string, resource string, value interface{}) (err error) {
+	collection, resource = d.normalizeNames(collection, resource)
+	if collection == "" {
+		return fmt.Errorf("Missing collection - unable to read")
+	}
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to save record (no name)")
+	}
+	start := time.Now()
+	var b []byte
+	defer func() { d.observers.observe("read", start, len(b), err) }()
+
+	err = d.withTimeout(func() (err error) {
+		b, err = d.readRecord(collection, resource)
+		return err
+	})
+	if err != nil {
+		return opError("read", collection, resource, err)
+	}
+	return d.decode(collection, b, value)
+}
+
+// ReadCompact returns the stored record with insignificant whitespace removed,
+// without decoding it. It returns ErrNotFound if the record does not exist.
+func (d *Driver) ReadCompact(collection string, resource string) ([]byte, error) {
+	collection, resource = d.normalizeNames(collection, resource)
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	if resource == "" {
+		return nil, fmt.Errorf("Missing resource - unable to read record (no name)")
+	}
+	b, err := d.readRecord(collection, resource)
+	if os.IsNotExist(err) {
+		return nil, notFound(collection, resource)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := json.Compact(&out, b); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// ReadResult is one entry of ReadManyOrdered. Data is nil and Found false
+// when the record does not exist.
+type ReadResult struct {
+	Resource string
+	Data     []byte
+	Found    bool
+}
+
+// ReadManyOrdered reads the given resources of collection under a single
+// read lock and returns one ReadResult per requested name, in the same order
+// (duplicates included). Missing records are reported with Found false
+// rather than failing the batch; any other error aborts it.
+func (d *Driver) ReadManyOrdered(collection string, resources []string) ([]ReadResult, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
 	mutex := d.getOrCreateMutex(collection)
-	mutex.Lock()
-	defer mutex.Unlock()
+	if err := d.acquire(collection, mutex, true); err != nil {
+		return nil, err
+	}
+	defer mutex.RUnlock()
 
-	dir := filepath.Join(d.dir, path)
+	results := make([]ReadResult, len(resources))
+	for i, resource := range resources {
+		results[i].Resource = resource
+		_, name := d.normalizeNames(collection, resource)
+		if name == "" {
+			continue
+		}
+		b, err := d.readRecord(collection, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, opError("read", collection, name, err)
+		}
+		results[i].Data, results[i].Found = b, true
+	}
+	return results, nil
+}
 
-	switch fi, err := stat(dir); {
-	case fi == nil, err != nil:
-		return fmt.Errorf("unable to find file or directory named %v\n", path)
-	case fi.Mode().IsDir():
-		return os.RemoveAll(dir)
-	case fi.Mode().IsRegular():
-		return os.RemoveAll(dir + ".json")
+// decode unmarshals a stored record of collection into value, honouring
+// StrictDecode for JSON records.
+func (d *Driver) decode(collection string, b []byte, value interface{}) error {
+	if c := d.codec(collection); !d.isJSON(collection) {
+		return c.Unmarshal(b, value)
+	}
+	if !d.opts.StrictDecode && !d.opts.UseNumber {
+		return json.Unmarshal(b, &value)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if d.opts.StrictDecode {
+		dec.DisallowUnknownFields()
+	}
+	if d.opts.UseNumber {
+		dec.UseNumber()
+	}
+	return dec.Decode(&value)
+}
+
+// decodeJSON unmarshals b into v for the map-based paths (queries, merges),
+// keeping numbers as json.Number when UseNumber is set.
+func (d *Driver) decodeJSON(b []byte, v interface{}) error {
+	if !d.opts.UseNumber {
+		return json.Unmarshal(b, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("invalid data after top-level JSON value")
 	}
 	return nil
 }
 
-func (d *Driver) getOrCreateMutex(collection string) *sync.Mutex {
+// readRecord returns the stored bytes of collection/resource, preferring a
+// value pending in the write buffer over the file on disk.
+func (d *Driver) readRecord(collection string, resource string) ([]byte, error) {
+	if d.closed.Load() {
+		return nil, ErrClosed
+	}
+	if err := validateRecordName(collection, resource); err != nil {
+		return nil, err
+	}
+	if err := d.authorize(OpRead, collection, resource); err != nil {
+		return nil, err
+	}
+	if b, ok := d.buffer.get(collection, resource); ok {
+		return b, nil
+	}
+
+	record := d.recordPath(collection, resource)
+
+	if _, err := d.stat(record); err != nil {
+		if !os.IsNotExist(err) {
+			if err := d.checkCollectionDir(collection); err != nil {
+				return nil, err
+			}
+		}
+		return nil, err
+	}
+	b, err := d.readFile(record)
+	if err != nil {
+		return nil, err
+	}
+	return d.loadRecord(collection, resource, b)
+}
+
+// ReadAll returns the contents of every record of collection, sorted by
+// resource name, with records that only exist in the write buffer last. It
+// takes no lock: the directory is listed once and each file read in turn, so
+// records deleted during the scan, even by a concurrent DropCollection, are
+// skipped rather than failing it. The result is a point-in-time-ish view.
+func (d *Driver) ReadAll(collection string) ([]string, error) {
+	return d.readAll(collection, false)
+}
+
+// ReadAllPartial is ReadAll that does not stop at the first record it cannot
+// read (permissions, failed decryption, ...): it returns every readable
+// record along with an error joining one failure per unreadable record, each
+// naming the record. Errors listing the collection itself still fail the
+// call with no records.
+func (d *Driver) ReadAllPartial(collection string) ([]string, error) {
+	return d.readAll(collection, true)
+}
+
+func (d *Driver) readAll(collection string, partial bool) ([]string, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	if err := d.authorize(OpRead, collection, ""); err != nil {
+		return nil, err
+	}
+	dir := d.collectionDir(collection)
+	pending := d.buffer.collection(collection)
+
+	if _, err := d.stat(dir); err != nil {
+		if len(pending) == 0 {
+			return nil, opError("readall", collection, "", err)
+		}
+	}
+	files, err := d.recordFiles(collection)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, opError("readall", collection, "", err)
+	}
+	var (
+		records []string
+		failed  []error
+	)
+	fail := func(resource string, err error) error {
+		err = opError("readall", collection, resource, err)
+		if !partial {
+			return err
+		}
+		failed = append(failed, err)
+		return nil
+	}
+	for _, x := range files {
+		if b, ok := pending[x.name]; ok {
+			records = append(records, string(b))
+			delete(pending, x.name)
+			continue
+		}
+		if x.info.Mode()&os.ModeSymlink != 0 && !d.opts.FollowSymlinks {
+			if err := d.checkContained(x.path); os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				if err := fail(x.name, err); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		data, err := d.readFile(x.path)
+		if os.IsNotExist(err) {
+			// Deleted since the directory was listed.
+			continue
+		}
+		if err == nil {
+			data, err = d.loadRecord(collection, x.name, data)
+		}
+		if err != nil {
+			if err := fail(x.name, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		records = append(records, string(data))
+	}
+	names := make([]string, 0, len(pending))
+	for name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		records = append(records, string(pending[name]))
+	}
+	return records, errors.Join(failed...)
+}
+
+// checkCollectionDir returns ErrNotCollection if the path of collection
+// exists but is not a directory. Callers use it to explain a failure, so it
+// is only consulted once something went wrong.
+func (d *Driver) checkCollectionDir(collection string) error {
+	dir := d.collectionDir(collection)
+	if fi, err := d.statFile(dir); err == nil && !fi.IsDir() {
+		return fmt.Errorf("%w: %s", ErrNotCollection, dir)
+	}
+	return nil
+}
+
+// recordFile is a record found on disk.
+type recordFile struct {
+	name string
+	path string
+	info os.FileInfo
+}
+
+// recordFiles lists the record files of collection on disk, sorted by name.
+// Temp files, hidden entries and the collection metadata file are skipped.
+// The collection name is validated first, so no listing can be pointed
+// outside the database with a name like "..".
+func (d *Driver) recordFiles(collection string) ([]recordFile, error) {
+	if err := validateName("collection", collection); err != nil {
+		return nil, err
+	}
+	if err := d.authorize(OpRead, collection, ""); err != nil {
+		return nil, err
+	}
+	dir := d.collectionDir(collection)
+	entries, err := d.readDir(dir)
+	if err != nil {
+		if err := d.checkCollectionDir(collection); err != nil {
+			return nil, err
+		}
+		return nil, err
+	}
+	ext := d.codec(collection).Extension()
+	_, standard := d.opts.PathResolver.(defaultResolver)
+	seen := make(map[string]bool)
+	var files []recordFile
+	for _, x := range entries {
+		name := x.Name()
+		if strings.HasPrefix(name, ".") || name == collectionMetaFile {
+			continue
+		}
+		if standard {
+			if !x.IsDir() && strings.HasSuffix(name, ext) {
+				files = append(files, recordFile{strings.TrimSuffix(name, ext), filepath.Join(dir, name), x})
+			}
+			continue
+		}
+		// With a custom layout, any entry may hold a record: ask the
+		// resolver where the record of that name would be and look there.
+		name = strings.TrimSuffix(name, ext)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		path := d.recordPath(collection, name)
+		if fi, err := d.lstat(path); err == nil && !fi.IsDir() {
+			files = append(files, recordFile{name, path, fi})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+// recordNames lists the resources stored in collection, including records
+// still pending in the write buffer, sorted by name.
+func (d *Driver) recordNames(collection string) ([]string, error) {
+	pending := d.buffer.collection(collection)
+	files, err := d.recordFiles(collection)
+	if err != nil && !(os.IsNotExist(err) && len(pending) > 0) {
+		return nil, err
+	}
+	var names []string
+	for _, x := range files {
+		if _, ok := pending[x.name]; !ok {
+			names = append(names, x.name)
+		}
+	}
+	for name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ReadAllByModTime is ReadAll with records ordered by file modification time,
+// newest first when descending is set. Ties are broken by resource name.
+// Records still in the write buffer count as modified now.
+func (d *Driver) ReadAllByModTime(collection string, descending bool) ([]string, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	type entry struct {
+		name    string
+		modTime time.Time
+	}
+	pending := d.buffer.collection(collection)
+	files, err := d.recordFiles(collection)
+	if err != nil && !(os.IsNotExist(err) && len(pending) > 0) {
+		return nil, err
+	}
+	entries := make([]entry, 0, len(files)+len(pending))
+	for _, x := range files {
+		if _, ok := pending[x.name]; !ok {
+			entries = append(entries, entry{x.name, x.info.ModTime()})
+		}
+	}
+	now := time.Now()
+	for name := range pending {
+		entries = append(entries, entry{name, now})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if descending {
+			a, b = b, a
+		}
+		if !a.modTime.Equal(b.modTime) {
+			return a.modTime.Before(b.modTime)
+		}
+		return entries[i].name < entries[j].name
+	})
+
+	records := make([]string, 0, len(entries))
+	for _, e := range entries {
+		b, err := d.readRecord(collection, e.name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, string(b))
+	}
+	return records, nil
+}
+
+// ReadRecent returns the n most recently modified records of collection,
+// newest first, with ties broken by resource name. Only the directory is
+// listed in full; the n newest entries are picked with a bounded heap and
+// only those records are read, so it is much cheaper than ReadAllByModTime
+// for a small n. Records still in the write buffer count as modified now.
+// Fewer than n records are returned if the collection is smaller.
+func (d *Driver) ReadRecent(collection string, n int) ([][]byte, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	if err := validateName("collection", collection); err != nil {
+		return nil, err
+	}
+	if err := d.authorize(OpRead, collection, ""); err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	pending := d.buffer.collection(collection)
+	files, err := d.recordFiles(collection)
+	if err != nil && !(os.IsNotExist(err) && len(pending) > 0) {
+		return nil, err
+	}
+	h := &recentHeap{}
+	push := func(e recentEntry) {
+		if h.Len() < n {
+			heap.Push(h, e)
+		} else if (*h)[0].older(e) {
+			(*h)[0] = e
+			heap.Fix(h, 0)
+		}
+	}
+	for _, x := range files {
+		if _, ok := pending[x.name]; !ok {
+			push(recentEntry{x.name, x.info.ModTime()})
+		}
+	}
+	now := time.Now()
+	for name := range pending {
+		push(recentEntry{name, now})
+	}
+
+	entries := make([]recentEntry, h.Len())
+	for i := len(entries) - 1; i >= 0; i-- {
+		entries[i] = heap.Pop(h).(recentEntry)
+	}
+	records := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		b, err := d.readRecord(collection, e.name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, b)
+	}
+	return records, nil
+}
+
+type recentEntry struct {
+	name    string
+	modTime time.Time
+}
+
+// older reports whether e sorts after o in newest-first order.
+func (e recentEntry) older(o recentEntry) bool {
+	if !e.modTime.Equal(o.modTime) {
+		return e.modTime.Before(o.modTime)
+	}
+	return e.name > o.name
+}
+
+// recentHeap is a min-heap with the oldest entry on top, so the newest n
+// entries are kept by replacing the top.
+type recentHeap []recentEntry
+
+func (h recentHeap) Len() int            { return len(h) }
+func (h recentHeap) Less(i, j int) bool  { return h[i].older(h[j]) }
+func (h recentHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *recentHeap) Push(x interface{}) { *h = append(*h, x.(recentEntry)) }
+func (h *recentHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Keys returns the resource names of collection, sorted.
+func (d *Driver) Keys(collection string) ([]string, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	if err := validateName("collection", collection); err != nil {
+		return nil, err
+	}
+	if err := d.authorize(OpRead, collection, ""); err != nil {
+		return nil, err
+	}
+	return d.index.keys(d, collection, func() ([]string, error) {
+		return d.recordNames(collection)
+	})
+}
+
+// Count returns the number of records in collection.
+func (d *Driver) Count(collection string) (int, error) {
+	keys, err := d.Keys(collection)
+	return len(keys), err
+}
+
+// CachedCount returns the number of records in collection from the key index
+// in O(1), without touching the disk. It needs Options.IndexKeys (or
+// MaxRecordsPerCollection, which turns the index on): without it nothing is
+// cached and the second result is always false. It is also false until Keys,
+// Count or Exists has loaded the collection, and after the collection is
+// dropped. Truncate leaves a count of zero. The index follows this driver's
+// own writes and deletes, but the cached value is not checked against the
+// directory, so changes made by other processes or by hand make it drift
+// until the next Keys or Count notices them.
+func (d *Driver) CachedCount(collection string) (int, bool) {
+	collection, _ = d.normalizeNames(collection, "")
+	return d.index.count(collection)
+}
+
+// Exists reports whether collection holds a record named resource.
+func (d *Driver) Exists(collection string, resource string) (bool, error) {
+	collection, resource = d.normalizeNames(collection, resource)
+	if collection == "" {
+		return false, fmt.Errorf("Missing collection - unable to read")
+	}
+	if resource == "" {
+		return false, fmt.Errorf("Missing resource - unable to read record (no name)")
+	}
+	if err := validateRecordName(collection, resource); err != nil {
+		return false, err
+	}
+	if err := d.authorize(OpRead, collection, resource); err != nil {
+		return false, err
+	}
+	if _, ok := d.buffer.get(collection, resource); ok {
+		return true, nil
+	}
+	if found, ok := d.index.contains(d, collection, resource); ok {
+		return found, nil
+	}
+	fi, err := d.stat(d.recordPath(collection, resource))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return fi.Mode().IsRegular(), nil
+}
+
+// ReadAllRawMessages returns every record of collection as a json.RawMessage,
+// in resource-name order, ready to be forwarded without decoding. A record
+// that is not valid JSON is reported as an error.
+func (d *Driver) ReadAllRawMessages(collection string) ([]json.RawMessage, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	names, err := d.recordNames(collection)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]json.RawMessage, 0, len(names))
+	for _, name := range names {
+		b, err := d.readRecord(collection, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !json.Valid(b) {
+			return nil, fmt.Errorf("record %s/%s is not valid JSON", collection, name)
+		}
+		records = append(records, json.RawMessage(b))
+	}
+	return records, nil
+}
+
+func (d *Driver) Delete(collection string, resource string) (err error) {
+	collection, resource = d.normalizeNames(collection, resource)
+	start := time.Now()
+	defer func() { d.observers.observe("delete", start, 0, err) }()
+
+	err = d.withTimeout(func() error {
+		return d.delete(collection, resource)
+	})
+	if collection == "" {
+		return err
+	}
+	return opError("delete", collection, resource, err)
+}
+
+func (d *Driver) delete(collection string, resource string) error {
+	if collection == "" {
+		return fmt.Errorf("Missing collection - unable to delete")
+	}
+	if err := validateName("collection", collection); err != nil {
+		return err
+	}
+	if resource != "" {
+		if err := validateName("resource", resource); err != nil {
+			return err
+		}
+	}
+	if d.opts.DenyDeletes {
+		return fmt.Errorf("%w: deletes are disabled", ErrImmutable)
+	}
+	if err := d.authorize(OpDelete, collection, resource); err != nil {
+		return err
+	}
+	path := filepath.Join(collection, resource)
+
+	// Removing a whole collection holds the same mutex that writeRecord holds
+	// around its MkdirAll, so a concurrent Write either lands before the
+	// directory is removed or recreates it afterwards, never in between.
+	mutex := d.getOrCreateMutex(collection)
+	if err := d.acquire(collection, mutex, false); err != nil {
+		return err
+	}
+	defer mutex.Unlock()
+	// Discard only now, so no flush can run between dropping the pending
+	// records and removing the files.
+	discarded := d.buffer.discard(collection, resource)
+
+	if resource != "" {
+		if fi, err := d.stat(d.recordPath(collection, resource)); err == nil && fi.Mode().IsRegular() {
+			return d.deleteRecord(collection, resource)
+		}
+	}
+	dir := filepath.Join(d.collectionDir(collection), resource)
+
+	switch fi, err := d.stat(dir); {
+	case fi == nil, err != nil:
+		if discarded {
+			d.index.remove(d, collection, resource)
+			return nil
+		}
+		if d.opts.IgnoreMissingOnDelete {
+			return nil
+		}
+		return fmt.Errorf("unable to find file or directory named %v\n", path)
+	case fi.Mode().IsDir():
+		if err := d.autoBackup(collection, dir); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		atomic.AddUint64(&d.stats.deletes, 1)
+		d.index.drop(collection)
+		d.emit(OpDelete, collection, resource)
+		if resource == "" {
+			return d.forgetCollection(collection)
+		}
+		return nil
+	case fi.Mode().IsRegular():
+		return d.deleteRecord(collection, resource)
+	}
+	return nil
+}
+
+// deleteRecord is removeRecord for Delete: with SoftDelete set the record is
+// moved to a tombstone instead. The caller must hold the collection mutex.
+func (d *Driver) deleteRecord(collection string, resource string) error {
+	if d.opts.DenyDeletes {
+		return fmt.Errorf("%w: deletes are disabled", ErrImmutable)
+	}
+	if d.opts.SoftDelete {
+		return d.tombstoneRecord(collection, resource)
+	}
+	return d.removeRecord(collection, resource)
+}
+
+// removeRecord deletes the file of collection/resource and accounts for the
+// deletion. The caller must hold the collection mutex.
+func (d *Driver) removeRecord(collection string, resource string) error {
+	if d.opts.DenyDeletes {
+		return fmt.Errorf("%w: deletes are disabled", ErrImmutable)
+	}
+	if err := d.authorize(OpDelete, collection, resource); err != nil {
+		return err
+	}
+	path := d.recordPath(collection, resource)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if folder, ok := d.recordFolder(collection, resource); ok {
+		// Attachments go with the record.
+		os.RemoveAll(folder)
+	}
+	d.recordRemoved(collection, resource, path)
+	return nil
+}
+
+// recordRemoved accounts for the record file at path having been removed.
+func (d *Driver) recordRemoved(collection string, resource string, path string) {
+	if dir := filepath.Dir(path); dir != d.collectionDir(collection) {
+		// Folder-per-record layouts: drop the record folder once empty.
+		os.Remove(dir)
+	}
+	atomic.AddUint64(&d.stats.deletes, 1)
+	d.index.remove(d, collection, resource)
+	d.emit(OpDelete, collection, resource)
+}
+
+// withTimeout runs fn, giving up with ErrTimeout once Options.OpTimeout has
+// elapsed. A timed out fn keeps running in the background (and keeps holding
+// whatever lock it took) until the filesystem call it is stuck in returns.
+func (d *Driver) withTimeout(fn func() error) error {
+	if d.opts.OpTimeout <= 0 {
+		return fn()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	timer := time.NewTimer(d.opts.OpTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
+
+// Sync flushes any records staged by the write buffer to disk. It is a no-op
+// when buffering is disabled.
+func (d *Driver) Sync() error {
+	return d.buffer.flush()
+}
+
+// Reopen re-attaches the driver to its directory after the data behind it
+// was replaced, typically by flipping a symlink to a new dataset. It flushes
+// the write buffer, takes every collection lock so in-flight operations
+// finish first, checks that the directory exists, re-resolves it and clears
+// the key index and reloads the collection manifest. Paths are always built
+// from the directory as given to New, so later operations see the new data.
+//
+// Buffered writes are flushed to wherever the directory points when Reopen
+// runs; call Sync before swapping to keep them with the old dataset. Records
+// held open with Open keep the collection read-locked, so Reopen waits until
+// they are closed; files opened by callers outside the driver keep reading
+// the old data. Lifetime stats carry over and are saved into the new
+// directory.
+func (d *Driver) Reopen() error {
+	if d.fsys != nil {
+		return ErrReadOnly
+	}
+	if d.closed.Load() {
+		return ErrClosed
+	}
+	if err := d.buffer.flush(); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	collections := sortedKeys(d.mutexes)
+	d.mutex.Unlock()
+	for _, collection := range collections {
+		mutex := d.getOrCreateMutex(collection)
+		if err := d.lock(collection, mutex, false); err != nil {
+			return err
+		}
+		defer mutex.Unlock()
+	}
+
+	if fi, err := os.Stat(d.dir); err != nil {
+		return fmt.Errorf("database directory '%s' does not exist: %w", d.dir, err)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("database directory '%s' is not a directory", d.dir)
+	}
+	root, err := filepath.EvalSymlinks(d.dir)
+	if err != nil {
+		return err
+	}
+	if d.manifest != nil {
+		if err := d.manifest.reload(); err != nil {
+			return err
+		}
+	}
+	d.index.reset()
+	d.mutex.Lock()
+	d.root = root
+	d.mutex.Unlock()
+	d.log.Debug("Reopened '%s' (now '%s')\n", d.dir, root)
+	return nil
+}
+
+// FlushResource writes the pending value of collection/resource to disk now
+// rather than at the end of its DebounceWindow or the next buffer flush.
+// Writes accumulated in the meantime end up in a single atomic file rewrite.
+// It is a no-op when nothing is pending for the record.
+func (d *Driver) FlushResource(collection string, resource string) error {
+	collection, resource = d.normalizeNames(collection, resource)
+	if collection == "" {
+		return fmt.Errorf("Missing collection - no place to save records")
+	}
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to save records (no name)")
+	}
+	return opError("flush", collection, resource, d.buffer.flushResource(collection, resource))
+}
+
+// Close flushes pending buffered writes, persists the lifetime stats and
+// stops background work. Operations started after Close fail with ErrClosed;
+// before flushing, Close takes every collection lock in turn, so writes (and
+// records held open with Open) that were in flight have finished when it
+// returns. Calling Close again is a no-op.
+func (d *Driver) Close() error {
+	if !d.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	d.mutex.Lock()
+	collections := sortedKeys(d.mutexes)
+	d.mutex.Unlock()
+	for _, collection := range collections {
+		mutex := d.getOrCreateMutex(collection)
+		mutex.Lock()
+		mutex.Unlock()
+	}
+
+	err := d.buffer.close()
+	if statsErr := d.stats.close(); err == nil {
+		err = statsErr
+	}
+	return err
+}
+
+// lockCollection flushes any buffered writes for collection and then locks it,
+// so a read-modify-write sees the latest data. Call the returned func to
+// release the lock.
+func (d *Driver) lockCollection(collection string) (func(), error) {
+	return d.lockCollections(collection)
+}
+
+// lockCollections is lockCollection for several collections. Locks are always
+// taken in sorted name order so two callers locking overlapping sets cannot
+// deadlock each other. This is an invariant for the whole driver: anything
+// holding more than one collection lock at a time must take them here, or in
+// the same order (as CloneCollection does), and never lock another
+// collection while holding one.
+func (d *Driver) lockCollections(collections ...string) (func(), error) {
+	names := append([]string(nil), collections...)
+	sort.Strings(names)
+	for _, name := range names {
+		if err := d.buffer.flushCollection(name); err != nil {
+			return nil, err
+		}
+	}
+	var mutexes []*sync.RWMutex
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+		mutex := d.getOrCreateMutex(name)
+		if err := d.acquire(name, mutex, false); err != nil {
+			for i := len(mutexes) - 1; i >= 0; i-- {
+				mutexes[i].Unlock()
+			}
+			return nil, err
+		}
+		mutexes = append(mutexes, mutex)
+	}
+	return func() {
+		for i := len(mutexes) - 1; i >= 0; i-- {
+			mutexes[i].Unlock()
+		}
+	}, nil
+}
+
+// lstat is os.Lstat, or fs.Stat for drivers created by NewFromFS.
+func (d *Driver) lstat(path string) (os.FileInfo, error) {
+	if d.fsys != nil {
+		return d.statFile(path)
+	}
+	return os.Lstat(path)
+}
+
+// acquire takes the write lock of mutex, or the read lock when shared is
+// set. With Options.LockTimeout set it gives up after that long, logging a
+// warning that names collection, and returns ErrLockTimeout. Waiting is done
+// by polling, so a waiter with a timeout does not queue behind the holder
+// the way a plain Lock does and may keep losing to other lockers.
+//
+// Every change to the database takes a write lock, so this is also where
+// drivers created by NewFromFS refuse to modify anything, and where closed
+// drivers refuse new operations.
+func (d *Driver) acquire(collection string, mutex *sync.RWMutex, shared bool) error {
+	if !shared && d.fsys != nil {
+		return ErrReadOnly
+	}
+	if d.closed.Load() {
+		return ErrClosed
+	}
+	if err := d.lock(collection, mutex, shared); err != nil {
+		return err
+	}
+	// Close may have swept the locks while this call was waiting.
+	if d.closed.Load() {
+		if shared {
+			mutex.RUnlock()
+		} else {
+			mutex.Unlock()
+		}
+		return ErrClosed
+	}
+	return nil
+}
+
+// lock is acquire without the closed check, for the write buffer, which
+// still has to flush while the driver closes.
+func (d *Driver) lock(collection string, mutex *sync.RWMutex, shared bool) error {
+	lock, try := mutex.Lock, mutex.TryLock
+	if shared {
+		lock, try = mutex.RLock, mutex.TryRLock
+	}
+	timeout := d.opts.LockTimeout
+	if timeout <= 0 {
+		lock()
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	for wait := time.Millisecond; !try(); {
+		if time.Now().After(deadline) {
+			d.log.Warn("Timed out after %v waiting for the lock of collection '%s'\n", timeout, collection)
+			return fmt.Errorf("%w: collection %s", ErrLockTimeout, collection)
+		}
+		time.Sleep(wait)
+		if wait < 50*time.Millisecond {
+			wait *= 2
+		}
+	}
+	return nil
+}
+
+// validateName checks that name can be used as a single path element.
+func validateName(kind string, name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%w: missing %s name", ErrInvalidName, kind)
+	case name == "." || name == "..", strings.ContainsAny(name, "/\\\x00"):
+		return fmt.Errorf("%w: %s name %q", ErrInvalidName, kind, name)
+	}
+	return checkReserved(kind, name)
+}
+
+// checkReserved returns ErrReservedName if name is reserved for kind
+// ("collection" or "resource"); see ErrReservedName.
+func checkReserved(kind string, name string) error {
+	if strings.HasPrefix(name, ".") || (kind == "resource" && name == strings.TrimSuffix(collectionMetaFile, ".json")) {
+		return fmt.Errorf("%w: %s name %q", ErrReservedName, kind, name)
+	}
+	return nil
+}
+
+// validateRecordName applies validateName to both parts of a record name,
+// so names coming from callers, streams or imports cannot reach outside
+// their directory.
+func validateRecordName(collection string, resource string) error {
+	if err := validateName("collection", collection); err != nil {
+		return err
+	}
+	return validateName("resource", resource)
+}
+
+// checkWriteOnce fails with ErrImmutable when WriteOnce is set and
+// collection/resource already exists on disk. The write buffer checks its
+// own pending records.
+func (d *Driver) checkWriteOnce(collection string, resource string) error {
+	if !d.opts.WriteOnce {
+		return nil
+	}
+	if _, err := d.stat(d.recordPath(collection, resource)); err == nil {
+		return fmt.Errorf("%w: %s/%s", ErrImmutable, collection, resource)
+	}
+	return nil
+}
+
+// checkRecordLimit fails with ErrTooManyRecords when
+// MaxRecordsPerCollection is set and writing collection/resource would
+// create a record past it. pending holds the records of collection waiting
+// in the write buffer, which count towards the limit; the buffer passes
+// them, since reading them here could deadlock a flush.
+func (d *Driver) checkRecordLimit(collection string, resource string, pending map[string][]byte) error {
+	max := d.opts.MaxRecordsPerCollection
+	if max <= 0 {
+		return nil
+	}
+	if _, ok := pending[resource]; ok {
+		return nil
+	}
+	tooMany := fmt.Errorf("%w: %s already holds %d", ErrTooManyRecords, collection, max)
+	// The index also holds the names of pending records.
+	if found, ok := d.index.contains(d, collection, resource); ok {
+		if n, _ := d.index.count(collection); found || n < max {
+			return nil
+		}
+		return tooMany
+	}
+	// Build the entry, so only the first check after it was dropped or went
+	// stale lists the directory.
+	names, err := d.index.keys(d, collection, func() ([]string, error) {
+		files, err := d.recordFiles(collection)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		var names []string
+		for _, x := range files {
+			if _, ok := pending[x.name]; !ok {
+				names = append(names, x.name)
+			}
+		}
+		for name := range pending {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	})
+	if err != nil {
+		return err
+	}
+	if i := sort.SearchStrings(names, resource); i < len(names) && names[i] == resource {
+		return nil
+	}
+	if len(names) >= max {
+		return tooMany
+	}
+	return nil
+}
+
+// normalizeNames prepares the names passed to the record methods, and every
+// public method taking a record name calls it first: a trailing ".json" is
+// stripped from resource, since the driver adds it itself (so "Ravi.json"
+// and "Ravi" name the same record instead of "Ravi.json" being stored as
+// Ravi.json.json), and both names are lowercased when CaseInsensitiveNames
+// is set.
+func (d *Driver) normalizeNames(collection string, resource string) (string, string) {
+	return normalize(collection, resource, d.opts.CaseInsensitiveNames)
+}
+
+// normalize is normalizeNames for a store with the given
+// CaseInsensitiveNames setting.
+func normalize(collection string, resource string, caseInsensitive bool) (string, string) {
+	if caseInsensitive {
+		collection, resource = strings.ToLower(collection), strings.ToLower(resource)
+	}
+	if trimmed := strings.TrimSuffix(resource, ".json"); trimmed != "" {
+		// Never turn a record name into "", which Delete reads as the
+		// whole collection.
+		resource = trimmed
+	}
+	return collection, resource
+}
+
+// authorize asks Options.Authorize whether op may touch
+// collection/resource.
+func (d *Driver) authorize(op Op, collection, resource string) error {
+	if d.opts.Authorize == nil {
+		return nil
+	}
+	return d.opts.Authorize(op, collection, resource)
+}
+
+// opError prefixes a filesystem error with the operation and the record it
+// concerned, e.g. "write users/john: ...". The error stays reachable with
+// errors.Is and errors.As; note that os.IsNotExist does not look through the
+// wrapping, so callers should use errors.Is(err, fs.ErrNotExist) instead.
+// A nil err is returned as nil.
+func opError(op string, collection string, resource string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if resource == "" {
+		return fmt.Errorf("%s %s: %w", op, collection, err)
+	}
+	return fmt.Errorf("%s %s/%s: %w", op, collection, resource, err)
+}
+
+// ioError marks err as ErrIO when it comes from the filesystem. Errors from
+// the driver's own checks, such as ErrImmutable or a refusal by
+// Options.Authorize, are returned unchanged so they can be matched.
+func ioError(err error) error {
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	if errors.As(err, &pathErr) || errors.As(err, &linkErr) {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	return err
+}
+
+func notFound(collection string, resource string) error {
+	return fmt.Errorf("%w: %s/%s", ErrNotFound, collection, resource)
+}
+
+func (d *Driver) getOrCreateMutex(collection string) *sync.RWMutex {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	m, ok := d.mutexes[collection]
 	if !ok {
-		m = &sync.Mutex{}
+		m = &sync.RWMutex{}
 		d.mutexes[collection] = m
 	}
 	return m
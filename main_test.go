@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestDriver opens a driver on a fresh temporary directory.
+func newTestDriver(t testing.TB, opts *Options) (*Driver, string) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "db")
+	d, err := New(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d, dir
+}
+
+func TestRecordNamesCannotEscape(t *testing.T) {
+	d, dir := newTestDriver(t, nil)
+	outside := filepath.Join(filepath.Dir(dir), "escaped.json")
+
+	for _, name := range []string{"../escaped", "a/../../escaped", "..", `a\b`} {
+		if err := d.Write("users", name, 1); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Write(%q) = %v, want ErrInvalidName", name, err)
+		}
+		var v int
+		if err := d.Read("users", name, &v); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Read(%q) = %v, want ErrInvalidName", name, err)
+		}
+		if err := d.Delete("users", name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Delete(%q) = %v, want ErrInvalidName", name, err)
+		}
+	}
+	if err := d.Write("../outside", "x", 1); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("Write into ../outside = %v, want ErrInvalidName", err)
+	}
+	if _, err := os.Stat(outside); !os.IsNotExist(err) {
+		t.Fatalf("record escaped the database directory: %v", err)
+	}
+}
+
+func TestSymlinkedCollectionOutsideIsRefused(t *testing.T) {
+	d, dir := newTestDriver(t, nil)
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "old.json"), []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "linked")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+
+	if err := d.Write("linked", "new", 2); !errors.Is(err, ErrSymlinkEscape) {
+		t.Fatalf("Write = %v, want ErrSymlinkEscape", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.json")); !os.IsNotExist(err) {
+		t.Fatalf("Write followed the symlink out of the database: %v", err)
+	}
+	var v int
+	if err := d.Read("linked", "old", &v); !errors.Is(err, ErrSymlinkEscape) {
+		t.Fatalf("Read = %v, want ErrSymlinkEscape", err)
+	}
+
+	follow, err := New(dir, &Options{FollowSymlinks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follow.Close()
+	if err := follow.Write("linked", "new", 2); err != nil {
+		t.Fatalf("Write with FollowSymlinks = %v", err)
+	}
+	if err := follow.Read("linked", "new", &v); err != nil || v != 2 {
+		t.Fatalf("Read with FollowSymlinks = %d, %v", v, err)
+	}
+}
+
+func TestSymlinkInsideDatabaseIsAllowed(t *testing.T) {
+	d, dir := newTestDriver(t, nil)
+	if err := d.Write("real", "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "real"), filepath.Join(dir, "alias")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	if err := d.Write("alias", "b", 2); err != nil {
+		t.Fatalf("Write through an internal symlink = %v", err)
+	}
+	var v int
+	if err := d.Read("real", "b", &v); err != nil || v != 2 {
+		t.Fatalf("Read = %d, %v", v, err)
+	}
+}
+
+func TestWriteTempNamesAreUnique(t *testing.T) {
+	final := filepath.Join(t.TempDir(), "x.json")
+	first, err := writeTemp(context.Background(), final, []byte("1"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := writeTemp(context.Background(), final, []byte("2"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("both writes used temp file %s", first)
+	}
+	for _, path := range []string{first, second} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("temp file %s: %v", path, err)
+		}
+	}
+}
+
+func TestConcurrentDurableWritesOfOneRecord(t *testing.T) {
+	d, dir := newTestDriver(t, &Options{Durable: true})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(j%3)*time.Millisecond)
+				err := d.WriteContext(ctx, "c", "x", i)
+				cancel()
+				if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := d.Write("c", "x", 42); err != nil {
+		t.Fatal(err)
+	}
+	// Abandoned fsyncs clean up after themselves.
+	time.Sleep(50 * time.Millisecond)
+	leftovers, _ := filepath.Glob(filepath.Join(dir, "c", "*.tmp"))
+	if len(leftovers) > 0 {
+		t.Fatalf("temp files left behind: %v", leftovers)
+	}
+}
+
+func TestMaxRecordsPerCollection(t *testing.T) {
+	for _, opts := range []*Options{
+		{MaxRecordsPerCollection: 2},
+		{MaxRecordsPerCollection: 2, WriteBufferSize: 10},
+	} {
+		d, _ := newTestDriver(t, opts)
+		for _, name := range []string{"ann", "bob"} {
+			if err := d.Write("users", name, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Write("users", "cid", 1); !errors.Is(err, ErrTooManyRecords) {
+			t.Fatalf("Write past the limit (buffer %d) = %v, want ErrTooManyRecords", opts.WriteBufferSize, err)
+		}
+		if err := d.Write("users", "ann", 2); err != nil {
+			t.Fatalf("update at the limit (buffer %d): %v", opts.WriteBufferSize, err)
+		}
+		if err := d.Delete("users", "bob"); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Write("users", "cid", 1); err != nil {
+			t.Fatalf("Write after a delete (buffer %d): %v", opts.WriteBufferSize, err)
+		}
+		if n, ok := d.CachedCount("users"); !ok || n != 2 {
+			t.Fatalf("CachedCount (buffer %d) = %d, %v; want 2, true", opts.WriteBufferSize, n, ok)
+		}
+	}
+}
+
+func TestReadAllConcurrentWithDelete(t *testing.T) {
+	d, _ := newTestDriver(t, &Options{IgnoreMissingOnDelete: true})
+	names := make([]string, 50)
+	for i := range names {
+		names[i] = fmt.Sprintf("r%02d", i)
+		if err := d.Write("items", names[i], i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			for i, name := range names {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := d.Write("items", name, i); err != nil {
+					t.Errorf("Write: %v", err)
+					return
+				}
+				if err := d.Delete("items", names[(i+25)%len(names)]); err != nil {
+					t.Errorf("Delete: %v", err)
+					return
+				}
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		records, err := d.ReadAll("items")
+		if err != nil {
+			t.Errorf("ReadAll during deletes: %v", err)
+			break
+		}
+		for _, r := range records {
+			var v int
+			if err := json.Unmarshal([]byte(r), &v); err != nil {
+				t.Errorf("ReadAll returned a broken record %q: %v", r, err)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// BenchmarkWriteSameCollection writes large records to one collection from
+// every CPU; marshaling happens before the collection lock is taken, so it
+// runs in parallel and only the file write is serialized.
+func BenchmarkWriteSameCollection(b *testing.B) {
+	d, _ := newTestDriver(b, nil)
+	value := make(map[string]string, 200)
+	for i := 0; i < 200; i++ {
+		value[fmt.Sprintf("field%03d", i)] = "some fairly long string value to marshal"
+	}
+	var workers int64
+	b.RunParallel(func(pb *testing.PB) {
+		worker := atomic.AddInt64(&workers, 1)
+		for i := 0; pb.Next(); i++ {
+			if err := d.Write("hot", fmt.Sprintf("w%d-%d", worker, i%100), value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestStatDoesNotAppendExtensionTwice(t *testing.T) {
+	d, dir := newTestDriver(t, nil)
+	if err := d.Write("users", "bob", 1); err != nil {
+		t.Fatal(err)
+	}
+	// Left behind by a version that stored "ann.json" as ann.json.json.
+	if err := os.WriteFile(filepath.Join(dir, "users", "ann.json.json"), []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.Exists("users", "ann"); err != nil || ok {
+		t.Fatalf("Exists(ann) = %v, %v; want false", ok, err)
+	}
+	if _, err := d.ReadAll("orders"); err == nil || strings.Contains(err.Error(), "orders.json") {
+		t.Fatalf("ReadAll of a missing collection = %v, want an error about the orders directory", err)
+	}
+}
+
+// writeSecretOutside puts a record-like file next to the database
+// directory, where no collection name may reach.
+func writeSecretOutside(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(filepath.Dir(dir), "secret.json"), []byte(`"do not list"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListingsRejectParentCollection(t *testing.T) {
+	for _, opts := range []*Options{nil, {IndexKeys: true}} {
+		d, dir := newTestDriver(t, opts)
+		writeSecretOutside(t, dir)
+		if keys, err := d.Keys(".."); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Keys(..) = %v, %v; want ErrInvalidName", keys, err)
+		}
+		if n, err := d.Count(".."); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Count(..) = %d, %v; want ErrInvalidName", n, err)
+		}
+		if records, err := d.ReadRecent("..", 10); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("ReadRecent(..) = %d records, %v; want ErrInvalidName", len(records), err)
+		}
+	}
+}
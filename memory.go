@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// Memory is a Store that keeps records in maps instead of files. Records are
+// encoded exactly as Driver stores them and the same errors are returned for
+// missing records and bad names, so it can stand in for a Driver in tests.
+// It is safe for concurrent use. Nothing is persisted.
+type Memory struct {
+	mutex           sync.RWMutex
+	collections     map[string]map[string][]byte
+	caseInsensitive bool
+}
+
+// NewMemory returns an empty in-memory store. Names are normalized as a
+// Driver opened with options normalizes them; the other options are
+// ignored. A nil options is the same as the zero Options.
+func NewMemory(options *Options) *Memory {
+	m := &Memory{collections: make(map[string]map[string][]byte)}
+	if options != nil {
+		m.caseInsensitive = options.CaseInsensitiveNames
+	}
+	return m
+}
+
+// notExist mirrors the error a Driver returns when reading a missing record:
+// errors.Is(err, fs.ErrNotExist) reports true for it.
+func notExist(op, collection, resource string) error {
+	err := &os.PathError{Op: "stat", Path: path.Join(collection, resource), Err: os.ErrNotExist}
+	return opError(op, collection, resource, err)
+}
+
+func checkNames(collection, resource string) error {
+	if collection == "" {
+		return fmt.Errorf("Missing collection - no place to save records")
+	}
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to save records (no name)")
+	}
+	return validateRecordName(collection, resource)
+}
+
+func marshalMemory(value interface{}) ([]byte, error) {
+	b, err := json.MarshalIndent(value, "", "\t")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMarshal, err)
+	}
+	return append(b, byte('\n')), nil
+}
+
+// put stores b; the caller must hold the write lock.
+func (m *Memory) put(collection, resource string, b []byte) {
+	records, ok := m.collections[collection]
+	if !ok {
+		records = make(map[string][]byte)
+		m.collections[collection] = records
+	}
+	records[resource] = b
+}
+
+func (m *Memory) Write(collection, resource string, value interface{}) error {
+	collection, resource = normalize(collection, resource, m.caseInsensitive)
+	if err := checkNames(collection, resource); err != nil {
+		return err
+	}
+	b, err := marshalMemory(value)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.put(collection, resource, b)
+	return nil
+}
+
+func (m *Memory) Read(collection, resource string, value interface{}) error {
+	collection, resource = normalize(collection, resource, m.caseInsensitive)
+	if collection == "" {
+		return fmt.Errorf("Missing collection - unable to read")
+	}
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to save record (no name)")
+	}
+	if err := validateRecordName(collection, resource); err != nil {
+		return err
+	}
+	m.mutex.RLock()
+	b, ok := m.collections[collection][resource]
+	m.mutex.RUnlock()
+	if !ok {
+		return notExist("read", collection, resource)
+	}
+	return json.Unmarshal(b, &value)
+}
+
+func (m *Memory) ReadAll(collection string) ([]string, error) {
+	collection, _ = normalize(collection, "", m.caseInsensitive)
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	if err := validateName("collection", collection); err != nil {
+		return nil, err
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	records, ok := m.collections[collection]
+	if !ok {
+		return nil, notExist("readall", collection, "")
+	}
+	var all []string
+	for _, name := range sortedKeys(records) {
+		all = append(all, string(records[name]))
+	}
+	return all, nil
+}
+
+// Create stores value only if resource does not exist yet, failing with
+// ErrAlreadyExists otherwise.
+func (m *Memory) Create(collection, resource string, value interface{}) error {
+	collection, resource = normalize(collection, resource, m.caseInsensitive)
+	if err := checkNames(collection, resource); err != nil {
+		return err
+	}
+	b, err := marshalMemory(value)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.collections[collection][resource]; ok {
+		return fmt.Errorf("%w: %s/%s", ErrAlreadyExists, collection, resource)
+	}
+	m.put(collection, resource, b)
+	return nil
+}
+
+// Replace overwrites an existing record, failing with ErrNotFound if the
+// resource does not exist.
+func (m *Memory) Replace(collection, resource string, value interface{}) error {
+	collection, resource = normalize(collection, resource, m.caseInsensitive)
+	if err := checkNames(collection, resource); err != nil {
+		return err
+	}
+	b, err := marshalMemory(value)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.collections[collection][resource]; !ok {
+		return notFound(collection, resource)
+	}
+	m.put(collection, resource, b)
+	return nil
+}
+
+// Delete removes a record, or the whole collection when resource is empty.
+// As with a Driver, removing the last record leaves the collection in place.
+func (m *Memory) Delete(collection, resource string) error {
+	collection, resource = normalize(collection, resource, m.caseInsensitive)
+	if collection == "" {
+		return fmt.Errorf("Missing collection - unable to delete")
+	}
+	if err := validateName("collection", collection); err != nil {
+		return err
+	}
+	if resource != "" {
+		if err := validateName("resource", resource); err != nil {
+			return err
+		}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	records, ok := m.collections[collection]
+	if ok && resource == "" {
+		delete(m.collections, collection)
+		return nil
+	}
+	if _, found := records[resource]; !found {
+		err := fmt.Errorf("unable to find file or directory named %v\n", path.Join(collection, resource))
+		return opError("delete", collection, resource, err)
+	}
+	delete(records, resource)
+	return nil
+}
+
+func (m *Memory) Keys(collection string) ([]string, error) {
+	collection, _ = normalize(collection, "", m.caseInsensitive)
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	if err := validateName("collection", collection); err != nil {
+		return nil, err
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	records, ok := m.collections[collection]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: collection, Err: os.ErrNotExist}
+	}
+	return sortedKeys(records), nil
+}
+
+func (m *Memory) Count(collection string) (int, error) {
+	keys, err := m.Keys(collection)
+	return len(keys), err
+}
+
+func (m *Memory) Exists(collection, resource string) (bool, error) {
+	collection, resource = normalize(collection, resource, m.caseInsensitive)
+	if collection == "" {
+		return false, fmt.Errorf("Missing collection - unable to read")
+	}
+	if resource == "" {
+		return false, fmt.Errorf("Missing resource - unable to read record (no name)")
+	}
+	if err := validateRecordName(collection, resource); err != nil {
+		return false, err
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	_, ok := m.collections[collection][resource]
+	return ok, nil
+}
+
+func (m *Memory) Collections() ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return sortedKeys(m.collections), nil
+}
+
+// Close is a no-op; it exists to satisfy Store.
+func (m *Memory) Close() error {
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
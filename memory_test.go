@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// TestMemoryMatchesDriver runs the same calls against a Driver and a Memory
+// store with the same options and expects the same outcome from both.
+func TestMemoryMatchesDriver(t *testing.T) {
+	opts := &Options{CaseInsensitiveNames: true}
+	d, _ := newTestDriver(t, opts)
+	for name, s := range map[string]Store{"Driver": d, "Memory": NewMemory(opts)} {
+		t.Run(name, func(t *testing.T) {
+			if err := s.Write("USERS", "Ann.json", person{Name: "Ann"}); err != nil {
+				t.Fatal(err)
+			}
+			var p person
+			if err := s.Read("users", "ann", &p); err != nil || p.Name != "Ann" {
+				t.Errorf("Read = %+v, %v; want Ann", p, err)
+			}
+			if ok, err := s.Exists("Users", "ANN"); err != nil || !ok {
+				t.Errorf("Exists = %v, %v; want true", ok, err)
+			}
+			if err := s.Delete("users", "ann.json"); err != nil {
+				t.Fatal(err)
+			}
+			// The collection outlives its last record.
+			if keys, err := s.Keys("users"); err != nil || len(keys) != 0 {
+				t.Errorf("Keys = %v, %v; want an empty collection", keys, err)
+			}
+			if names, err := s.Collections(); err != nil || !reflect.DeepEqual(names, []string{"users"}) {
+				t.Errorf("Collections = %v, %v; want [users]", names, err)
+			}
+
+			if err := s.Read("..", "ann", &p); !errors.Is(err, ErrInvalidName) {
+				t.Errorf("Read(..) = %v, want ErrInvalidName", err)
+			}
+			if _, err := s.Exists("users", "../ann"); !errors.Is(err, ErrInvalidName) {
+				t.Errorf("Exists(../ann) = %v, want ErrInvalidName", err)
+			}
+			if _, err := s.Keys(".."); !errors.Is(err, ErrInvalidName) {
+				t.Errorf("Keys(..) = %v, want ErrInvalidName", err)
+			}
+		})
+	}
+}
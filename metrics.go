@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// opObserver receives the outcome of every Write, Read and Delete: the
+// operation name, how long it took, the size of the record in bytes (zero
+// for deletes) and the error returned, if any.
+type opObserver func(op string, elapsed time.Duration, size int, err error)
+
+// opObservers is the hook metrics exporters attach to. It keeps the core free
+// of any metrics dependency and costs a read lock per operation when nothing
+// is attached.
+type opObservers struct {
+	mutex sync.RWMutex
+	list  []opObserver
+}
+
+func (o *opObservers) add(fn opObserver) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.list = append(o.list, fn)
+}
+
+func (o *opObservers) observe(op string, start time.Time, size int, err error) {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	if len(o.list) == 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	for _, fn := range o.list {
+		fn(op, elapsed, size, err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+type person struct {
+	Name string
+	Tags []string
+}
+
+// exerciseRecordMethods calls every record method with collection and
+// resource, which must both resolve to the record users/ann, and fails if
+// any of them reaches another record or leaves another file behind.
+func exerciseRecordMethods(t *testing.T, d *Driver, dir, collection, resource string) {
+	t.Helper()
+	if err := d.Write("users", "ann", person{Name: "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("users", "bob", person{Name: "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Create(collection, resource, person{}); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Create = %v, want ErrAlreadyExists", err)
+	}
+	if err := d.Replace(collection, resource, person{Name: "Ann"}); err != nil {
+		t.Errorf("Replace: %v", err)
+	}
+	if err := d.WithRecord(collection, resource, func(b []byte) ([]byte, error) { return b, nil }); err != nil {
+		t.Errorf("WithRecord: %v", err)
+	}
+	if err := d.MergePatch(collection, resource, []byte(`{"Name":"Ann"}`)); err != nil {
+		t.Errorf("MergePatch: %v", err)
+	}
+	if err := d.AppendToArray(collection, resource, "Tags", "admin"); err != nil {
+		t.Errorf("AppendToArray: %v", err)
+	}
+	var p person
+	if err := d.GetOrCreate(collection, resource, &p, func() interface{} { return person{Name: "new"} }); err != nil || p.Name != "Ann" {
+		t.Errorf("GetOrCreate = %+v, %v; want the existing record", p, err)
+	}
+	if _, err := d.WriteIfChanged(collection, resource, p); err != nil {
+		t.Errorf("WriteIfChanged: %v", err)
+	}
+	if err := UpsertMany(d, collection, map[string]person{resource: p}, nil); err != nil {
+		t.Errorf("UpsertMany: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := d.Swap(collection, resource, "bob"); err != nil {
+			t.Errorf("Swap: %v", err)
+		}
+	}
+	if err := d.Delete(collection, resource); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if err := d.Undelete(collection, resource); err != nil {
+		t.Errorf("Undelete: %v", err)
+	}
+
+	p = person{}
+	if err := d.Read("users", "ann", &p); err != nil || !reflect.DeepEqual(p, person{Name: "Ann", Tags: []string{"admin"}}) {
+		t.Errorf("Read = %+v, %v; want Ann with the admin tag", p, err)
+	}
+	if names := visibleFiles(t, dir); !reflect.DeepEqual(names, []string{"users"}) {
+		t.Errorf("database holds %v, want [users]", names)
+	}
+	if names := visibleFiles(t, filepath.Join(dir, "users")); !reflect.DeepEqual(names, []string{"ann.json", "bob.json"}) {
+		t.Errorf("collection holds %v, want [ann.json bob.json]", names)
+	}
+}
+
+// exerciseCollectionMethods calls every collection method with collection,
+// which must resolve to users, and fails if any of them reaches another
+// collection or leaves another directory behind.
+func exerciseCollectionMethods(t *testing.T, d *Driver, dir, collection string) {
+	t.Helper()
+	if err := d.Write("users", "ann", person{Name: "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("users", "bob", person{Name: "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(method string, n int, err error) {
+		t.Helper()
+		if err != nil || n != 2 {
+			t.Errorf("%s = %d records, %v; want 2", method, n, err)
+		}
+	}
+	keys, err := d.Keys(collection)
+	count("Keys", len(keys), err)
+	n, err := d.Count(collection)
+	count("Count", n, err)
+	all, err := d.ReadAll(collection)
+	count("ReadAll", len(all), err)
+	recent, err := d.ReadRecent(collection, 10)
+	count("ReadRecent", len(recent), err)
+	byTime, err := d.ReadAllByModTime(collection, false)
+	count("ReadAllByModTime", len(byTime), err)
+	raw, err := d.ReadAllRawMessages(collection)
+	count("ReadAllRawMessages", len(raw), err)
+	parallel, err := d.ReadAllParallel(collection, 2)
+	count("ReadAllParallel", len(parallel), err)
+	composite, err := d.ReadAllComposite(collection)
+	count("ReadAllComposite", len(composite), err)
+	c, err := d.Cursor(collection)
+	n = 0
+	if err == nil {
+		for c.Next() {
+			n++
+		}
+		err = c.Err()
+		c.Close()
+	}
+	count("Cursor", n, err)
+	snap, err := d.Snapshot(collection)
+	n = 0
+	if err == nil {
+		n = len(snap.Keys())
+	}
+	count("Snapshot", n, err)
+	if err := d.Prefetch(collection); err != nil {
+		t.Errorf("Prefetch: %v", err)
+	}
+	found, err := d.Find(collection, nil)
+	count("Find", len(found), err)
+	queried, err := Query(d, collection, func(person) bool { return true })
+	count("Query", len(queried), err)
+	queried, err = QueryParallel(d, collection, 2, func(person) bool { return true })
+	count("QueryParallel", len(queried), err)
+	n, err = CountWhere(d, collection, func(person) bool { return true })
+	count("CountWhere", n, err)
+	dupes, err := d.FindDuplicates(collection, nil)
+	if err != nil || len(dupes) != 0 {
+		t.Errorf("FindDuplicates = %v, %v; want none", dupes, err)
+	}
+	want, _ := d.CollectionHash("users")
+	if got, err := d.CollectionHash(collection); err != nil || got != want {
+		t.Errorf("CollectionHash = %q, %v; want %q", got, err, want)
+	}
+	if schema, err := d.InferSchema(collection); err != nil || schema["Name"] == "" {
+		t.Errorf("InferSchema = %v, %v; want the Name field", schema, err)
+	}
+	modified, err := d.ModifiedSince(collection, time.Time{})
+	count("ModifiedSince", len(modified), err)
+	sizes, err := d.RecordSizes(collection)
+	count("RecordSizes", len(sizes), err)
+	var out bytes.Buffer
+	_, err = d.Stream(collection).WriteTo(&out)
+	count("Stream", strings.Count(out.String(), "\n"), err)
+
+	byName := func(raw json.RawMessage) (string, error) {
+		var p person
+		err := json.Unmarshal(raw, &p)
+		return p.Name, err
+	}
+	if _, err := d.ImportNDJSON(collection, strings.NewReader(`{"Name":"cid"}`+"\n"), byName); err != nil {
+		t.Errorf("ImportNDJSON: %v", err)
+	}
+	if err := d.ImportAll(strings.NewReader(`{"` + collection + `":{"dan.json":{"Name":"dan"}}}`)); err != nil {
+		t.Errorf("ImportAll: %v", err)
+	}
+	d.Register(collection, person{})
+	if v, err := d.ReadAny(collection, "ann"); err != nil || v.(*person).Name != "Ann" {
+		t.Errorf("ReadAny = %+v, %v; want Ann", v, err)
+	}
+	if err := d.SetCollectionMeta(collection, map[string]interface{}{"owner": "ann"}); err != nil {
+		t.Errorf("SetCollectionMeta: %v", err)
+	}
+	if meta, err := d.GetCollectionMeta("users"); err != nil || meta["owner"] != "ann" {
+		t.Errorf("GetCollectionMeta = %v, %v; want the owner set through %q", meta, err, collection)
+	}
+	if err := d.CreateCollection(collection); !errors.Is(err, ErrCollectionExists) {
+		t.Errorf("CreateCollection = %v, want ErrCollectionExists", err)
+	}
+	if err := d.CloneCollection(collection, "copy", false); err != nil {
+		t.Errorf("CloneCollection: %v", err)
+	}
+	if err := d.RenameCollection("copy", "moved"); err != nil {
+		t.Errorf("RenameCollection: %v", err)
+	}
+	if n, err := d.DeleteOlderThan(collection, time.Hour); err != nil || n != 0 {
+		t.Errorf("DeleteOlderThan = %d, %v; want 0", n, err)
+	}
+	if _, err := d.PurgeDeleted(collection, 0); err != nil {
+		t.Errorf("PurgeDeleted: %v", err)
+	}
+	var backup bytes.Buffer
+	if err := d.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RestoreCollection(collection, io.Reader(&backup)); err != nil {
+		t.Errorf("RestoreCollection: %v", err)
+	}
+	for _, name := range []string{"ann", "bob", "cid", "dan"} {
+		if ok, err := d.Exists("users", name); err != nil || !ok {
+			t.Errorf("users/%s missing after the imports and restore: %v", name, err)
+		}
+	}
+	if n, err := d.Truncate(collection); err != nil || n != 4 {
+		t.Errorf("Truncate = %d, %v; want 4", n, err)
+	}
+
+	if names := visibleFiles(t, dir); !reflect.DeepEqual(names, []string{"moved", "users"}) {
+		t.Errorf("database holds %v, want [moved users]", names)
+	}
+}
+
+// visibleFiles lists dir without its hidden entries.
+func visibleFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, x := range entries {
+		if x.Name()[0] != '.' {
+			names = append(names, x.Name())
+		}
+	}
+	return names
+}
+
+func TestCaseInsensitiveNames(t *testing.T) {
+	d, dir := newTestDriver(t, &Options{CaseInsensitiveNames: true, SoftDelete: true})
+	exerciseRecordMethods(t, d, dir, "USERS", "Ann")
+}
+
+func TestCaseInsensitiveCollectionNames(t *testing.T) {
+	d, dir := newTestDriver(t, &Options{CaseInsensitiveNames: true, SoftDelete: true})
+	exerciseCollectionMethods(t, d, dir, "USERS")
+}
+
+func TestCaseSensitiveNamesByDefault(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("names are only reliably case-sensitive on Linux")
+	}
+	d, _ := newTestDriver(t, nil)
+	if err := d.Write("Users", "ann", person{Name: "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	var p person
+	if err := d.Read("users", "ann", &p); err == nil {
+		t.Fatal("Read of users found the record written to Users")
+	}
+}
+
+func TestJSONSuffixIsStripped(t *testing.T) {
+	for _, resource := range []string{"ann", "ann.json"} {
+		t.Run(resource, func(t *testing.T) {
+			d, dir := newTestDriver(t, &Options{SoftDelete: true})
+			exerciseRecordMethods(t, d, dir, "users", resource)
+			if ok, err := d.Exists("users", resource); err != nil || !ok {
+				t.Errorf("Exists(%q) = %v, %v; want true", resource, ok, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// lockedFile is a record file that keeps its collection read-locked until
+// it is closed.
+type lockedFile struct {
+	*os.File
+	once   sync.Once
+	unlock func()
+}
+
+func (f *lockedFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(f.unlock)
+	return err
+}
+
+type bytesReadSeekCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadSeekCloser) Close() error {
+	return nil
+}
+
+// Open returns the stored bytes of a record as a seekable stream, suitable
+// for http.ServeContent and range requests. The collection stays read-locked,
+// so writers wait, until the returned value is closed. Records that must be
+// transformed before they can be served (encrypted, deduplicated, subject to
+// ReadHooks, served from an fs.FS, or still in the write buffer) are loaded
+// into memory instead and do not hold the lock. Missing records and temp
+// files yield ErrNotFound.
+func (d *Driver) Open(collection, resource string) (io.ReadSeekCloser, error) {
+	collection, resource = d.normalizeNames(collection, resource)
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	if resource == "" || strings.HasSuffix(resource, ".tmp") {
+		return nil, notFound(collection, resource)
+	}
+	if err := d.authorize(OpRead, collection, resource); err != nil {
+		return nil, err
+	}
+
+	if d.opts.KeyProvider != nil || d.opts.DedupeContent || len(d.opts.ReadHooks) > 0 || d.fsys != nil {
+		b, err := d.readRecord(collection, resource)
+		if os.IsNotExist(err) {
+			return nil, notFound(collection, resource)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return bytesReadSeekCloser{bytes.NewReader(b)}, nil
+	}
+	if b, ok := d.buffer.get(collection, resource); ok {
+		return bytesReadSeekCloser{bytes.NewReader(b)}, nil
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	if err := d.acquire(collection, mutex, true); err != nil {
+		return nil, err
+	}
+	path := d.recordPath(collection, resource)
+	if _, err := d.stat(path); err != nil {
+		mutex.RUnlock()
+		if os.IsNotExist(err) {
+			return nil, notFound(collection, resource)
+		}
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		mutex.RUnlock()
+		if os.IsNotExist(err) {
+			return nil, notFound(collection, resource)
+		}
+		return nil, err
+	}
+	return &lockedFile{File: f, unlock: mutex.RUnlock}, nil
+}
+
+// WriteRecordTo copies the stored bytes of a record to w, for streaming
+// responses. The file is copied straight from disk under the collection read
+// lock, without loading it into memory, except for the records Open has to
+// load (see Open). Missing records yield ErrNotFound.
+func (d *Driver) WriteRecordTo(collection, resource string, w io.Writer) error {
+	r, err := d.Open(collection, resource)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// seedCollection writes n small records to collection.
+func seedCollection(b *testing.B, d *Driver, collection string, n int) {
+	b.Helper()
+	for i := 0; i < n; i++ {
+		if err := d.Write(collection, fmt.Sprintf("r%05d", i), map[string]int{"n": i}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadAll(b *testing.B) {
+	d, _ := newTestDriver(b, nil)
+	seedCollection(b, d, "items", 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := d.ReadAll("items"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadAllParallel(b *testing.B) {
+	d, _ := newTestDriver(b, nil)
+	seedCollection(b, d, "items", 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := d.ReadAllParallel("items", runtime.NumCPU()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+//go:build prometheus
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// driverCollector exposes a driver's operation metrics to Prometheus.
+type driverCollector struct {
+	ops     *prometheus.CounterVec
+	latency *prometheus.HistogramVec
+	size    *prometheus.HistogramVec
+}
+
+// Collector returns a prometheus.Collector reporting, per operation (write,
+// read, delete), the number of calls by result, their latency and the size
+// of the records involved. Register it once with a prometheus.Registry; each
+// call returns a new collector that only sees operations from then on.
+//
+// It is only available when building with the prometheus tag, so the default
+// build does not link the Prometheus client. The driver is package main,
+// which no other package can import, so the collector cannot live in a
+// subpackage; the build tag is what keeps it optional.
+func (d *Driver) Collector() prometheus.Collector {
+	c := &driverCollector{
+		ops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "godb_operations_total",
+			Help: "Number of driver operations, by operation and result.",
+		}, []string{"op", "result"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "godb_operation_duration_seconds",
+			Help:    "Latency of driver operations.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"op"}),
+		size: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "godb_record_size_bytes",
+			Help:    "Size of records written and read.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 10),
+		}, []string{"op"}),
+	}
+	d.observers.add(func(op string, elapsed time.Duration, size int, err error) {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		c.ops.WithLabelValues(op, result).Inc()
+		c.latency.WithLabelValues(op).Observe(elapsed.Seconds())
+		if err == nil && op != "delete" {
+			c.size.WithLabelValues(op).Observe(float64(size))
+		}
+	})
+	return c
+}
+
+func (c *driverCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.ops.Describe(ch)
+	c.latency.Describe(ch)
+	c.size.Describe(ch)
+}
+
+func (c *driverCollector) Collect(ch chan<- prometheus.Metric) {
+	c.ops.Collect(ch)
+	c.latency.Collect(ch)
+	c.size.Collect(ch)
+}
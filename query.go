@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Cond is a single condition evaluated by Find. Field is a top-level key or
+// a dotted path into nested objects (e.g. "Address.City"), Op is one of
+// ==, !=, <, >, <= and >=, and Value is compared against the stored value.
+// Numbers compare numerically and strings lexically; other types only
+// support == and !=.
+type Cond struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+// Find scans collection and returns the records matching every condition.
+// It decodes each record, so its cost grows with the collection size; there
+// is no index.
+func (d *Driver) Find(collection string, conds []Cond) ([]json.RawMessage, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	for _, c := range conds {
+		switch c.Op {
+		case "==", "!=", "<", ">", "<=", ">=":
+		default:
+			return nil, fmt.Errorf("unsupported operator %q in condition on %s", c.Op, c.Field)
+		}
+	}
+
+	names, err := d.recordNames(collection)
+	if err != nil {
+		return nil, err
+	}
+	var matches []json.RawMessage
+	for _, name := range names {
+		b, err := d.readRecord(collection, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var doc map[string]interface{}
+		if err := d.decodeJSON(b, &doc); err != nil {
+			// Records that are not JSON objects cannot match a field condition.
+			continue
+		}
+		if matchAll(doc, conds) {
+			matches = append(matches, json.RawMessage(b))
+		}
+	}
+	return matches, nil
+}
+
+func matchAll(doc map[string]interface{}, conds []Cond) bool {
+	for _, c := range conds {
+		v, ok := lookupField(doc, c.Field)
+		if !ok || !evaluate(v, c.Op, c.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupField resolves a dotted path such as "Address.City" in doc.
+func lookupField(doc map[string]interface{}, field string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, part := range strings.Split(field, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func evaluate(stored interface{}, op string, want interface{}) bool {
+	cmp, ordered := compareValues(stored, want)
+	equal := ordered && cmp == 0 || !ordered && reflect.DeepEqual(stored, want)
+	switch op {
+	case "==":
+		return equal
+	case "!=":
+		return !equal
+	case "<":
+		return ordered && cmp < 0
+	case ">":
+		return ordered && cmp > 0
+	case "<=":
+		return ordered && cmp <= 0
+	case ">=":
+		return ordered && cmp >= 0
+	}
+	return false
+}
+
+// compareValues orders a against b when both are numbers or both are
+// strings. The second result is false when they are not comparable.
+func compareValues(a, b interface{}) (int, bool) {
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// Query decodes every record of collection into a T and returns those for
+// which pred reports true, in resource-name order. A record that cannot be
+// decoded into T fails the query, unless Options.SkipUndecodable is set.
+func Query[T any](d *Driver, collection string, pred func(T) bool) ([]T, error) {
+	return QueryParallel(d, collection, 1, pred)
+}
+
+// QueryParallel is Query with the reads, decoding and pred calls spread over
+// up to workers goroutines. pred is called concurrently and must be safe for
+// concurrent use. Matches are returned in no particular order.
+func QueryParallel[T any](d *Driver, collection string, workers int, pred func(T) bool) ([]T, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	names, err := d.recordNames(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mutex    sync.Mutex
+		matches  []T
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	jobs := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range jobs {
+				b, err := d.readRecord(collection, name)
+				if os.IsNotExist(err) {
+					continue
+				}
+				var value T
+				if err == nil {
+					err = d.decode(collection, b, &value)
+				}
+				match := err == nil && pred(value)
+				if err != nil && d.opts.SkipUndecodable {
+					d.log.Warn("Skipping undecodable record %s/%s: %v\n", collection, name, err)
+					err = nil
+				}
+				mutex.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("record %s/%s: %w", collection, name, err)
+				}
+				if match {
+					matches = append(matches, value)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, name := range names {
+		jobs <- name
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return matches, nil
+}
+
+// CountWhere returns how many records of collection, decoded into a T,
+// satisfy pred. Records are decoded one at a time and none are kept, so
+// memory use does not grow with the collection. A record that cannot be
+// decoded into T fails the count, unless Options.SkipUndecodable is set, in
+// which case it is logged and not counted.
+func CountWhere[T any](d *Driver, collection string, pred func(T) bool) (int, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return 0, fmt.Errorf("Missing collection - unable to read")
+	}
+	names, err := d.recordNames(collection)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, name := range names {
+		b, err := d.readRecord(collection, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		var value T
+		if err := d.decode(collection, b, &value); err != nil {
+			if !d.opts.SkipUndecodable {
+				return 0, fmt.Errorf("record %s/%s: %w", collection, name, err)
+			}
+			d.log.Warn("Skipping undecodable record %s/%s: %v\n", collection, name, err)
+			continue
+		}
+		if pred(value) {
+			count++
+		}
+	}
+	return count, nil
+}
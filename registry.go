@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// typeRegistry maps collections to the Go type their records decode into.
+type typeRegistry struct {
+	mutex sync.RWMutex
+	types map[string]reflect.Type
+}
+
+func (r *typeRegistry) set(collection string, t reflect.Type) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.types == nil {
+		r.types = make(map[string]reflect.Type)
+	}
+	r.types[collection] = t
+}
+
+func (r *typeRegistry) get(collection string) (reflect.Type, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	t, ok := r.types[collection]
+	return t, ok
+}
+
+// Register records the type of proto as the record type of collection, for
+// use by ReadAny and ValidateAgainstRegistered. proto may be a value or a
+// pointer; only its type is kept. Registering again replaces the previous
+// type.
+func (d *Driver) Register(collection string, proto interface{}) {
+	collection, _ = d.normalizeNames(collection, "")
+	t := reflect.TypeOf(proto)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return
+	}
+	d.types.set(collection, t)
+}
+
+// ReadAny reads a record of a registered collection into a freshly allocated
+// value of the registered type and returns a pointer to it (e.g. *User).
+func (d *Driver) ReadAny(collection, resource string) (interface{}, error) {
+	collection, resource = d.normalizeNames(collection, resource)
+	t, ok := d.types.get(collection)
+	if !ok {
+		return nil, fmt.Errorf("no type registered for collection %v", collection)
+	}
+	value := reflect.New(t).Interface()
+	if err := d.Read(collection, resource, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// ValidateAgainstRegistered checks that data decodes cleanly into the type
+// registered for collection, so input can be validated before it is stored
+// without the caller knowing that type. JSON is decoded strictly: unknown
+// fields, mismatched field types and trailing data are all errors. Records of
+// collections with a non-JSON codec are checked with the codec's Unmarshal.
+func (d *Driver) ValidateAgainstRegistered(collection string, data []byte) error {
+	collection, _ = d.normalizeNames(collection, "")
+	t, ok := d.types.get(collection)
+	if !ok {
+		return fmt.Errorf("no type registered for collection %v", collection)
+	}
+	value := reflect.New(t).Interface()
+	if !d.isJSON(collection) {
+		if err := d.codec(collection).Unmarshal(data, value); err != nil {
+			return fmt.Errorf("record does not match %v: %w", t, err)
+		}
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(value); err != nil {
+		return fmt.Errorf("record does not match %v: %w", t, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("record does not match %v: unexpected data after the JSON value", t)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import "encoding/json"
+
+// relaxJSON turns a hand-edited record into strict JSON: // line comments and
+// /* block */ comments are removed and commas directly before a closing } or
+// ] are dropped. String contents are left untouched. Records that are already
+// valid JSON are returned as-is.
+func relaxJSON(b []byte) []byte {
+	if json.Valid(b) {
+		return b
+	}
+	out := make([]byte, 0, len(b))
+	// comma is the index in out of a comma that may still turn out to be
+	// trailing, or -1.
+	comma := -1
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c == '"':
+			comma = -1
+			start := i
+			for i++; i < len(b) && b[i] != '"'; i++ {
+				if b[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(b) {
+				i = len(b) - 1
+			}
+			out = append(out, b[start:i+1]...)
+		case c == '/' && i+1 < len(b) && b[i+1] == '/':
+			for i < len(b) && b[i] != '\n' {
+				i++
+			}
+			i--
+		case c == '/' && i+1 < len(b) && b[i+1] == '*':
+			i += 2
+			for i+1 < len(b) && !(b[i] == '*' && b[i+1] == '/') {
+				i++
+			}
+			i++
+			// Keep tokens on either side of the comment apart.
+			out = append(out, ' ')
+		case c == '}' || c == ']':
+			if comma >= 0 {
+				out = append(out[:comma], out[comma+1:]...)
+				comma = -1
+			}
+			out = append(out, c)
+		case c == ',':
+			comma = len(out)
+			out = append(out, c)
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			out = append(out, c)
+		default:
+			comma = -1
+			out = append(out, c)
+		}
+	}
+	return out
+}
@@ -0,0 +1,55 @@
+package main
+
+// ScopedDriver is a handle restricted to a single collection. It goes through
+// the parent Driver, so locking stays consistent with unscoped callers, but
+// it rejects resource names that could reach outside the collection and can
+// never delete the collection itself.
+type ScopedDriver struct {
+	d          *Driver
+	collection string
+}
+
+// Scope returns a handle whose operations are confined to collection.
+func (d *Driver) Scope(collection string) *ScopedDriver {
+	return &ScopedDriver{d: d, collection: collection}
+}
+
+// Collection returns the name of the collection the handle is scoped to.
+func (s *ScopedDriver) Collection() string {
+	return s.collection
+}
+
+func (s *ScopedDriver) check(resource string) error {
+	if err := validateName("collection", s.collection); err != nil {
+		return err
+	}
+	return validateName("resource", resource)
+}
+
+func (s *ScopedDriver) Write(resource string, value interface{}) error {
+	if err := s.check(resource); err != nil {
+		return err
+	}
+	return s.d.Write(s.collection, resource, value)
+}
+
+func (s *ScopedDriver) Read(resource string, value interface{}) error {
+	if err := s.check(resource); err != nil {
+		return err
+	}
+	return s.d.Read(s.collection, resource, value)
+}
+
+func (s *ScopedDriver) ReadAll() ([]string, error) {
+	if err := validateName("collection", s.collection); err != nil {
+		return nil, err
+	}
+	return s.d.ReadAll(s.collection)
+}
+
+func (s *ScopedDriver) Delete(resource string) error {
+	if err := s.check(resource); err != nil {
+		return err
+	}
+	return s.d.Delete(s.collection, resource)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Levels used by SlogLogger for the lumber levels slog has no equivalent for.
+const (
+	LevelTrace = slog.LevelDebug - 4
+	LevelFatal = slog.LevelError + 4
+)
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// SlogLogger adapts l to the Logger interface so the driver logs through
+// slog. Messages are formatted printf-style, as with lumber, and logged at
+// the matching slog level; Trace and Fatal use LevelTrace and LevelFatal.
+// As with lumber, Fatal does not exit the process.
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+func (s slogLogger) log(level slog.Level, format string, v ...interface{}) {
+	ctx := context.Background()
+	if !s.l.Enabled(ctx, level) {
+		return
+	}
+	s.l.Log(ctx, level, fmt.Sprintf(format, v...))
+}
+
+func (s slogLogger) Fatal(format string, v ...interface{}) { s.log(LevelFatal, format, v...) }
+func (s slogLogger) Error(format string, v ...interface{}) { s.log(slog.LevelError, format, v...) }
+func (s slogLogger) Warn(format string, v ...interface{})  { s.log(slog.LevelWarn, format, v...) }
+func (s slogLogger) Debug(format string, v ...interface{}) { s.log(slog.LevelDebug, format, v...) }
+func (s slogLogger) Trace(format string, v ...interface{}) { s.log(LevelTrace, format, v...) }
+func (s slogLogger) Info(format string, v ...interface{})  { s.log(slog.LevelInfo, format, v...) }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Snapshot is a point-in-time, in-memory copy of a collection. Reads from a
+// snapshot never touch the disk and are unaffected by later writes. It holds
+// the raw bytes of every record, so its memory use is roughly the on-disk size
+// of the collection; it is meant for small collections.
+type Snapshot struct {
+	collection string
+	taken      time.Time
+	records    map[string][]byte
+}
+
+// Snapshot copies every record of collection into memory. The collection read
+// lock is held while copying, so writers of this driver are held back and the
+// snapshot reflects a single point in time.
+func (d *Driver) Snapshot(collection string) (*Snapshot, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read")
+	}
+	mutex := d.getOrCreateMutex(collection)
+	if err := d.acquire(collection, mutex, true); err != nil {
+		return nil, err
+	}
+	defer mutex.RUnlock()
+
+	names, err := d.recordNames(collection)
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{
+		collection: collection,
+		taken:      time.Now(),
+		records:    make(map[string][]byte, len(names)),
+	}
+	for _, name := range names {
+		b, err := d.readRecord(collection, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.records[name] = b
+	}
+	return s, nil
+}
+
+// Get returns the bytes of resource as of the snapshot.
+func (s *Snapshot) Get(resource string) ([]byte, bool) {
+	b, ok := s.records[resource]
+	return b, ok
+}
+
+// Keys returns the resource names in the snapshot, sorted.
+func (s *Snapshot) Keys() []string {
+	keys := make([]string, 0, len(s.records))
+	for key := range s.records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Collection returns the name of the collection the snapshot was taken from.
+func (s *Snapshot) Collection() string {
+	return s.collection
+}
+
+// Taken returns when the snapshot was taken.
+func (s *Snapshot) Taken() time.Time {
+	return s.taken
+}
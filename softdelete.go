@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// deletedDir is the hidden directory of a collection holding tombstones: one
+// folder per resource, with one file per deletion named after its time.
+const deletedDir = ".deleted"
+
+func (d *Driver) tombstoneDir(collection, resource string) string {
+	return filepath.Join(d.collectionDir(collection), deletedDir, resource)
+}
+
+// tombstoneRecord moves the record file of collection/resource to a new
+// tombstone. The caller must hold the collection mutex.
+func (d *Driver) tombstoneRecord(collection, resource string) error {
+	if err := d.authorize(OpDelete, collection, resource); err != nil {
+		return err
+	}
+	path := d.recordPath(collection, resource)
+	dir := d.tombstoneDir(collection, resource)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	// Zero-padded so that tombstones sort by deletion time.
+	name := fmt.Sprintf("%020d.json", time.Now().UnixNano())
+	if err := os.Rename(path, filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	d.recordRemoved(collection, resource, path)
+	return nil
+}
+
+// tombstones returns the tombstone file names of resource, oldest first.
+func tombstones(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, x := range entries {
+		if !x.IsDir() && strings.HasSuffix(x.Name(), ".json") {
+			names = append(names, x.Name())
+		}
+	}
+	return names, nil
+}
+
+// Undelete restores the most recent tombstone of collection/resource. It
+// fails with ErrNotFound if there is none and with ErrAlreadyExists if the
+// resource has been written again since it was deleted.
+func (d *Driver) Undelete(collection, resource string) error {
+	collection, resource = d.normalizeNames(collection, resource)
+	if err := validateName("collection", collection); err != nil {
+		return err
+	}
+	if err := validateName("resource", resource); err != nil {
+		return err
+	}
+	if err := d.authorize(OpWrite, collection, resource); err != nil {
+		return err
+	}
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	dir := d.tombstoneDir(collection, resource)
+	names, err := tombstones(dir)
+	if os.IsNotExist(err) || (err == nil && len(names) == 0) {
+		return notFound(collection, resource)
+	}
+	if err != nil {
+		return err
+	}
+	path := d.recordPath(collection, resource)
+	if _, err := d.stat(path); err == nil {
+		return fmt.Errorf("%w: %s/%s", ErrAlreadyExists, collection, resource)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	if err := os.Rename(filepath.Join(dir, names[len(names)-1]), path); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	if len(names) == 1 {
+		os.Remove(dir)
+	}
+	d.index.add(d, collection, resource)
+	d.emit(OpWrite, collection, resource)
+	return nil
+}
+
+// PurgeDeleted permanently removes the tombstones of collection that are
+// older than olderThan and returns how many were removed.
+func (d *Driver) PurgeDeleted(collection string, olderThan time.Duration) (int, error) {
+	collection, _ = d.normalizeNames(collection, "")
+	if err := validateName("collection", collection); err != nil {
+		return 0, err
+	}
+	if err := d.authorize(OpDelete, collection, ""); err != nil {
+		return 0, err
+	}
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	root := filepath.Join(d.collectionDir(collection), deletedDir)
+	resources, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-olderThan).UnixNano()
+	purged := 0
+	for _, x := range resources {
+		if !x.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, x.Name())
+		names, err := tombstones(dir)
+		if err != nil {
+			return purged, err
+		}
+		for _, name := range names {
+			deleted, err := strconv.ParseInt(strings.TrimSuffix(name, ".json"), 10, 64)
+			if err != nil || deleted >= cutoff {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return purged, err
+			}
+			purged++
+		}
+		// Only succeeds once the folder is empty.
+		os.Remove(dir)
+	}
+	os.Remove(root)
+	return purged, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// metaDir is the internal collection holding driver bookkeeping. Being
+// hidden, it is never reported by Collections.
+const metaDir = ".meta"
+
+// LifetimeStats are counters that survive restarts: they are loaded from the
+// .meta collection in New and persisted periodically and on Close.
+type LifetimeStats struct {
+	Writes  uint64
+	Deletes uint64
+}
+
+type lifetimeCounters struct {
+	writes  uint64
+	deletes uint64
+	path    string
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func loadLifetimeCounters(dir string) (*lifetimeCounters, error) {
+	c := &lifetimeCounters{path: filepath.Join(dir, metaDir, "stats.json")}
+	b, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stats LifetimeStats
+	if err := json.Unmarshal(b, &stats); err != nil {
+		return nil, err
+	}
+	c.writes, c.deletes = stats.Writes, stats.Deletes
+	return c, nil
+}
+
+func (c *lifetimeCounters) snapshot() LifetimeStats {
+	return LifetimeStats{
+		Writes:  atomic.LoadUint64(&c.writes),
+		Deletes: atomic.LoadUint64(&c.deletes),
+	}
+}
+
+func (c *lifetimeCounters) save() error {
+	b, err := json.MarshalIndent(c.snapshot(), "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	tempPath := c.path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, c.path)
+}
+
+func (d *Driver) startStatsFlusher(interval time.Duration) {
+	c := d.stats
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.save(); err != nil {
+					d.log.Error("Unable to persist lifetime stats: %v\n", err)
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops the periodic flusher and persists the final counters.
+func (c *lifetimeCounters) close() error {
+	if c.stop != nil {
+		close(c.stop)
+		<-c.done
+		c.stop = nil
+	}
+	if c.path == "" {
+		// Read-only drivers keep no stats file.
+		return nil
+	}
+	return c.save()
+}
+
+// LifetimeStats returns the number of record writes and deletes performed by
+// this database over its whole life, including previous processes.
+func (d *Driver) LifetimeStats() LifetimeStats {
+	return d.stats.snapshot()
+}
@@ -0,0 +1,23 @@
+package main
+
+// Store is the record API shared by the filesystem Driver and the in-memory
+// Memory store. Code that only needs these operations can depend on Store and
+// use NewMemory in unit tests.
+type Store interface {
+	Write(collection, resource string, value interface{}) error
+	Read(collection, resource string, value interface{}) error
+	ReadAll(collection string) ([]string, error)
+	Create(collection, resource string, value interface{}) error
+	Replace(collection, resource string, value interface{}) error
+	Delete(collection, resource string) error
+	Keys(collection string) ([]string, error)
+	Count(collection string) (int, error)
+	Exists(collection, resource string) (bool, error)
+	Collections() ([]string, error)
+	Close() error
+}
+
+var (
+	_ Store = (*Driver)(nil)
+	_ Store = (*Memory)(nil)
+)
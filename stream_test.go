@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStreamReadFromRejectsTraversal(t *testing.T) {
+	d, dir := newTestDriver(t, nil)
+	in := `{"key":"ok","value":{"n":1}}` + "\n" + `{"key":"a/../../../escaped","value":{"n":2}}` + "\n"
+	_, err := d.Stream("users").ReadFrom(strings.NewReader(in))
+	if !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("ReadFrom = %v, want ErrInvalidName", err)
+	}
+	// users/a/../../../escaped resolves to the parent of the database.
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escaped.json")); !os.IsNotExist(err) {
+		t.Fatalf("stream wrote outside the database: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "users", "ok.json")); err != nil {
+		t.Fatalf("valid line before the bad one was not stored: %v", err)
+	}
+}
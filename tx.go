@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tx groups writes and deletes across collections so they are applied
+// together by Commit. Nothing touches the disk before Commit. A Tx is not
+// safe for concurrent use.
+type Tx struct {
+	d    *Driver
+	ops  []txOp
+	done bool
+}
+
+// txOp is one staged change; it is also the unit stored in the write-ahead
+// log.
+type txOp struct {
+	Delete     bool   `json:"delete,omitempty"`
+	Collection string `json:"collection"`
+	Resource   string `json:"resource"`
+	Data       []byte `json:"data,omitempty"`
+}
+
+// walDir holds the write-ahead logs of transactions being committed.
+var walDir = filepath.Join(metaDir, "wal")
+
+// Begin starts a transaction.
+func (d *Driver) Begin() *Tx {
+	return &Tx{d: d}
+}
+
+// Write stages value to be stored as collection/resource on Commit. The value
+// is serialized now, so later changes to it are not picked up.
+func (tx *Tx) Write(collection, resource string, value interface{}) error {
+	collection, resource = tx.d.normalizeNames(collection, resource)
+	if err := tx.check(collection, resource); err != nil {
+		return err
+	}
+	b, err := tx.d.marshalRecord(collection, value)
+	if err != nil {
+		return err
+	}
+	tx.ops = append(tx.ops, txOp{Collection: collection, Resource: resource, Data: b})
+	return nil
+}
+
+// Delete stages the removal of collection/resource on Commit. Deleting a
+// record that does not exist at commit time is not an error.
+func (tx *Tx) Delete(collection, resource string) error {
+	collection, resource = tx.d.normalizeNames(collection, resource)
+	if err := tx.check(collection, resource); err != nil {
+		return err
+	}
+	tx.ops = append(tx.ops, txOp{Delete: true, Collection: collection, Resource: resource})
+	return nil
+}
+
+func (tx *Tx) check(collection, resource string) error {
+	if tx.done {
+		return fmt.Errorf("transaction already finished")
+	}
+	if err := validateName("collection", collection); err != nil {
+		return err
+	}
+	return validateName("resource", resource)
+}
+
+// Rollback discards the staged changes. Since nothing is applied before
+// Commit, it never has anything to undo on disk.
+func (tx *Tx) Rollback() {
+	tx.done = true
+	tx.ops = nil
+}
+
+// Commit applies the staged changes in order while holding the locks of
+// every collection involved. If a change fails, the ones already applied are
+// undone and the error is returned, so other users of the driver see all of
+// the transaction or none of it. The locks are taken in sorted collection
+// order whatever the order of the staged changes, so transactions touching
+// the same collections in different orders cannot deadlock each other.
+//
+// Without Options.TransactionLog a crash in the middle of Commit can leave
+// the transaction partly applied. With it, the changes are first written
+// and fsynced to a write-ahead log, and New completes any transaction found
+// in the log, making commits crash-consistent.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return fmt.Errorf("transaction already finished")
+	}
+	tx.done = true
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	d := tx.d
+	var collections []string
+	for _, op := range tx.ops {
+		collections = append(collections, op.Collection)
+	}
+	unlock, err := d.lockCollections(collections...)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var walPath string
+	if d.opts.TransactionLog {
+		if walPath, err = d.writeWAL(tx.ops); err != nil {
+			return err
+		}
+		defer os.Remove(walPath)
+	}
+	return d.applyOps(tx.ops)
+}
+
+// writeWAL durably records ops and returns the path of the log file. With a
+// KeyProvider the record data is sealed the way the records themselves are,
+// so the log never holds plaintext.
+func (d *Driver) writeWAL(ops []txOp) (string, error) {
+	sealed := make([]txOp, len(ops))
+	for i, op := range ops {
+		if !op.Delete {
+			data, err := d.encryptRecord(op.Collection, op.Resource, op.Data)
+			if err != nil {
+				return "", err
+			}
+			op.Data = data
+		}
+		sealed[i] = op
+	}
+	b, err := json.Marshal(sealed)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrMarshal, err)
+	}
+	dir := filepath.Join(d.dir, walDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%020d.json", time.Now().UnixNano()))
+	tempPath, err := writeTemp(context.Background(), path, b, true)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	return path, nil
+}
+
+// applyOps applies ops in order, restoring the previous state of every
+// record it touched if one of them fails. The caller must hold the locks of
+// the collections involved.
+func (d *Driver) applyOps(ops []txOp) error {
+	type saved struct {
+		collection string
+		path       string
+		data       []byte
+		existed    bool
+		tombstone  string
+	}
+	var undo []saved
+	for _, op := range ops {
+		path := d.recordPath(op.Collection, op.Resource)
+		prev, err := ioutil.ReadFile(path)
+		if err == nil || os.IsNotExist(err) {
+			undo = append(undo, saved{op.Collection, path, prev, err == nil, ""})
+			switch {
+			case !op.Delete:
+				err = d.writeRecord(op.Collection, op.Resource, op.Data)
+			case err == nil:
+				if err = d.deleteRecord(op.Collection, op.Resource); err == nil && d.opts.SoftDelete {
+					// The newest tombstone is the one just made.
+					dir := d.tombstoneDir(op.Collection, op.Resource)
+					if names, _ := tombstones(dir); len(names) > 0 {
+						undo[len(undo)-1].tombstone = filepath.Join(dir, names[len(names)-1])
+					}
+				}
+			default:
+				err = nil
+			}
+		}
+		if err == nil {
+			continue
+		}
+		// Undo in reverse order so a record touched twice ends up as it
+		// was before the first change.
+		for i := len(undo) - 1; i >= 0; i-- {
+			s := undo[i]
+			if s.tombstone != "" {
+				os.Remove(s.tombstone)
+			}
+			if !s.existed {
+				os.Remove(s.path)
+			} else if os.MkdirAll(filepath.Dir(s.path), 0755) == nil && ioutil.WriteFile(s.path+".tmp", s.data, 0644) == nil {
+				os.Rename(s.path+".tmp", s.path)
+			}
+			d.index.drop(s.collection)
+		}
+		return err
+	}
+	return nil
+}
+
+// replayWAL completes the transactions whose log survived a crash. A log
+// that was not fully written belongs to a transaction that never started
+// applying, so it is discarded.
+func (d *Driver) replayWAL() error {
+	dir := filepath.Join(d.dir, walDir)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var logs []string
+	for _, x := range entries {
+		switch {
+		case strings.HasSuffix(x.Name(), ".tmp"):
+			os.Remove(filepath.Join(dir, x.Name()))
+		case strings.HasSuffix(x.Name(), ".json"):
+			logs = append(logs, x.Name())
+		}
+	}
+	sort.Strings(logs)
+	for _, name := range logs {
+		path := filepath.Join(dir, name)
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var ops []txOp
+		if err := json.Unmarshal(b, &ops); err != nil {
+			return fmt.Errorf("corrupt transaction log %s: %v", path, err)
+		}
+		for i, op := range ops {
+			if op.Delete {
+				continue
+			}
+			if ops[i].Data, err = d.decryptRecord(op.Collection, op.Resource, op.Data); err != nil {
+				return fmt.Errorf("transaction log %s: %w", path, err)
+			}
+		}
+		d.log.Warn("Replaying interrupted transaction %s (%d changes)\n", name, len(ops))
+		if err := d.applyOps(ops); err != nil {
+			return fmt.Errorf("replaying transaction log %s: %w", path, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTransactionsInOppositeOrderDoNotDeadlock(t *testing.T) {
+	d, _ := newTestDriver(t, nil)
+	var wg sync.WaitGroup
+	for _, order := range [][]string{{"accounts", "ledger"}, {"ledger", "accounts"}} {
+		order := order
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				tx := d.Begin()
+				for _, collection := range order {
+					if err := tx.Write(collection, "entry", i); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				if err := tx.Commit(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("transactions locking the same collections in opposite orders deadlocked")
+	}
+}
+
+func TestTransactionNamesAreNormalized(t *testing.T) {
+	d, dir := newTestDriver(t, &Options{CaseInsensitiveNames: true})
+	tx := d.Begin()
+	if err := tx.Write("USERS", "Ann.json", person{Name: "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Write("Users", "BOB", person{Name: "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete("USERS", "Bob.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var p person
+	if err := d.Read("users", "ann", &p); err != nil || p.Name != "Ann" {
+		t.Errorf("Read = %+v, %v; want Ann", p, err)
+	}
+	if names := visibleFiles(t, filepath.Join(dir, "users")); !reflect.DeepEqual(names, []string{"ann.json"}) {
+		t.Errorf("collection holds %v, want [ann.json]", names)
+	}
+}
+
+func TestTransactionDeleteHonoursSoftDelete(t *testing.T) {
+	d, _ := newTestDriver(t, &Options{SoftDelete: true})
+	if err := d.Write("users", "ann", person{Name: "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	tx := d.Begin()
+	if err := tx.Delete("users", "ann"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Undelete("users", "ann"); err != nil {
+		t.Fatalf("Undelete after a transactional delete: %v", err)
+	}
+	var p person
+	if err := d.Read("users", "ann", &p); err != nil || p.Name != "Ann" {
+		t.Errorf("Read = %+v, %v; want Ann", p, err)
+	}
+}
+
+func TestTransactionLogIsEncrypted(t *testing.T) {
+	opts := encryptedOptions()
+	opts.TransactionLog = true
+	d, dir := newTestDriver(t, opts)
+	path, err := d.writeWAL([]txOp{{Collection: "users", Resource: "ann", Data: []byte(`{"Name":"Ann"}`)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []txOp
+	if err := json.Unmarshal(b, &ops); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || bytes.Contains(ops[0].Data, []byte("Ann")) {
+		t.Fatalf("transaction log holds the record in plaintext: %q", ops[0].Data)
+	}
+
+	// Reopening replays the log, which must restore the plaintext record.
+	d.Close()
+	if d, err = New(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var p person
+	if err := d.Read("users", "ann", &p); err != nil || p.Name != "Ann" {
+		t.Errorf("Read = %+v, %v; want Ann", p, err)
+	}
+}
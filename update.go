@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Swap exchanges the contents of two records of collection while holding the
+// collection lock, so no other operation of this driver observes a half-done
+// swap. If either record is missing, or either write fails, an error is
+// returned and nothing is changed.
+func (d *Driver) Swap(collection, resourceA, resourceB string) error {
+	collection, resourceA = d.normalizeNames(collection, resourceA)
+	_, resourceB = d.normalizeNames(collection, resourceB)
+	if collection == "" {
+		return fmt.Errorf("Missing collection - unable to swap records")
+	}
+	if resourceA == "" || resourceB == "" {
+		return fmt.Errorf("Missing resource - unable to swap records (no name)")
+	}
+	if resourceA == resourceB {
+		return nil
+	}
+
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	a, err := d.readRecord(collection, resourceA)
+	if os.IsNotExist(err) {
+		return notFound(collection, resourceA)
+	}
+	if err != nil {
+		return err
+	}
+	b, err := d.readRecord(collection, resourceB)
+	if os.IsNotExist(err) {
+		return notFound(collection, resourceB)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Both temp files are written before either record is replaced, so a
+	// failing write (hooks, encryption, disk) leaves both records intact.
+	defer d.lockBlobs()()
+	ctx := context.Background()
+	stagedA, err := d.stageRecord(ctx, collection, resourceA, b)
+	if err != nil {
+		return err
+	}
+	stagedB, err := d.stageRecord(ctx, collection, resourceB, a)
+	if err != nil {
+		stagedA.abort()
+		return err
+	}
+	if err := d.commitRecord(ctx, stagedA); err != nil {
+		stagedB.abort()
+		return err
+	}
+	if err := d.commitRecord(ctx, stagedB); err != nil {
+		// Put A back so the swap is all or nothing.
+		if undo, undoErr := d.stageRecord(ctx, collection, resourceA, a); undoErr != nil {
+			d.log.Error("Unable to roll back swap of %s/%s: %v\n", collection, resourceA, undoErr)
+		} else if undoErr := d.commitRecord(ctx, undo); undoErr != nil {
+			d.log.Error("Unable to roll back swap of %s/%s: %v\n", collection, resourceA, undoErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// UpsertMany merges records into collection under a single collection lock.
+// For each key, if a record already exists it is decoded and resolve(existing,
+// incoming) is stored; otherwise incoming is stored as-is. A nil resolve means
+// last write wins. Keys are normalized like the names of Write, and two keys
+// naming the same record are an error. Keys are processed in sorted order
+// and the first failure stops the batch, leaving earlier keys written.
+func UpsertMany[T any](d *Driver, collection string, records map[string]T, resolve func(existing, incoming T) T) error {
+	if collection == "" {
+		return fmt.Errorf("Missing collection - no place to save records")
+	}
+	collection, _ = d.normalizeNames(collection, "")
+	keys := make([]string, 0, len(records))
+	values := make(map[string]T, len(records))
+	for key, value := range records {
+		_, name := d.normalizeNames(collection, key)
+		if name == "" {
+			return fmt.Errorf("Missing resource - unable to save records (no name)")
+		}
+		if _, ok := values[name]; ok {
+			return fmt.Errorf("keys of UpsertMany name the same record %s/%s", collection, name)
+		}
+		keys = append(keys, name)
+		values[name] = value
+	}
+	sort.Strings(keys)
+
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, key := range keys {
+		value := values[key]
+		if resolve != nil {
+			b, err := d.readRecord(collection, key)
+			switch {
+			case err == nil:
+				var existing T
+				if err := d.decode(collection, b, &existing); err != nil {
+					return fmt.Errorf("%s/%s: %w", collection, key, err)
+				}
+				value = resolve(existing, value)
+			case !os.IsNotExist(err):
+				return err
+			}
+		}
+		b, err := d.marshalRecord(collection, value)
+		if err != nil {
+			return err
+		}
+		if err := d.writeRecord(collection, key, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteIfChanged writes value only if its serialized form differs from what
+// is already stored, and reports whether a write happened. Idempotent writers
+// can use it to avoid needless disk churn.
+func (d *Driver) WriteIfChanged(collection, resource string, value interface{}) (bool, error) {
+	collection, resource = d.normalizeNames(collection, resource)
+	if collection == "" {
+		return false, fmt.Errorf("Missing collection - no place to save records")
+	}
+	if resource == "" {
+		return false, fmt.Errorf("Missing resource - unable to save records (no name)")
+	}
+	b, err := d.marshalRecord(collection, value)
+	if err != nil {
+		return false, err
+	}
+
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	existing, err := d.readRecord(collection, resource)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil && bytes.Equal(existing, b) {
+		return false, nil
+	}
+	if err := d.writeRecord(collection, resource, b); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Create writes value as a new record, failing with ErrAlreadyExists if the
+// resource is already present. The check and the write happen under the
+// collection lock, so two concurrent Creates of the same resource cannot
+// both succeed.
+func (d *Driver) Create(collection, resource string, value interface{}) error {
+	collection, resource = d.normalizeNames(collection, resource)
+	if collection == "" {
+		return fmt.Errorf("Missing collection - no place to save records")
+	}
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to save records (no name)")
+	}
+	b, err := d.marshalRecord(collection, value)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := d.readRecord(collection, resource); err == nil {
+		return fmt.Errorf("%w: %s/%s", ErrAlreadyExists, collection, resource)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return d.writeRecord(collection, resource, b)
+}
+
+// GetOrCreate reads collection/resource into value, first storing create()
+// if the record does not exist yet. The check, the creation and the read
+// all happen under the collection lock, so concurrent callers agree on a
+// single created value.
+func (d *Driver) GetOrCreate(collection, resource string, value interface{}, create func() interface{}) error {
+	collection, resource = d.normalizeNames(collection, resource)
+	if collection == "" {
+		return fmt.Errorf("Missing collection - no place to save records")
+	}
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to save records (no name)")
+	}
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	b, err := d.readRecord(collection, resource)
+	if os.IsNotExist(err) {
+		if b, err = d.marshalRecord(collection, create()); err != nil {
+			return err
+		}
+		if err := d.writeRecord(collection, resource, b); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return d.decode(collection, b, value)
+}
+
+// Replace overwrites an existing record with value, failing with ErrNotFound
+// if the resource does not exist. Like Create, the check and the write happen
+// under the collection lock.
+func (d *Driver) Replace(collection, resource string, value interface{}) error {
+	collection, resource = d.normalizeNames(collection, resource)
+	if collection == "" {
+		return fmt.Errorf("Missing collection - no place to save records")
+	}
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to save records (no name)")
+	}
+	b, err := d.marshalRecord(collection, value)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := d.readRecord(collection, resource); os.IsNotExist(err) {
+		return notFound(collection, resource)
+	} else if err != nil {
+		return err
+	}
+	return d.writeRecord(collection, resource, b)
+}
+
+// WithRecord runs fn on the stored bytes of an existing record and writes
+// the bytes fn returns in its place, holding the collection lock throughout,
+// so fn can implement any read-compute-write without racing other writers.
+// The returned bytes are stored as-is. If fn returns nil bytes the record is
+// left unchanged; if it returns an error nothing is written and the error is
+// returned. Missing records yield ErrNotFound. fn must not call back into the
+// driver for the same collection, as the lock is not reentrant.
+func (d *Driver) WithRecord(collection, resource string, fn func(data []byte) ([]byte, error)) error {
+	collection, resource = d.normalizeNames(collection, resource)
+	if collection == "" {
+		return fmt.Errorf("Missing collection - no place to save records")
+	}
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to save records (no name)")
+	}
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	b, err := d.readRecord(collection, resource)
+	if os.IsNotExist(err) {
+		return notFound(collection, resource)
+	}
+	if err != nil {
+		return err
+	}
+	out, err := fn(b)
+	if err != nil || out == nil {
+		return err
+	}
+	return d.writeRecord(collection, resource, out)
+}
+
+// AppendToArray appends items to the top-level array field of an existing
+// record, creating the field if it is absent, all under the collection lock.
+// It fails if the record is missing (ErrNotFound), is not a JSON object, or
+// if field holds something other than an array.
+func (d *Driver) AppendToArray(collection, resource, field string, items ...interface{}) error {
+	collection, resource = d.normalizeNames(collection, resource)
+	if collection == "" {
+		return fmt.Errorf("Missing collection - no place to save records")
+	}
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to save records (no name)")
+	}
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	b, err := d.readRecord(collection, resource)
+	if os.IsNotExist(err) {
+		return notFound(collection, resource)
+	}
+	if err != nil {
+		return err
+	}
+	doc, err := d.decodeMap(b)
+	if err != nil {
+		return fmt.Errorf("record %s/%s is not a JSON object: %v", collection, resource, err)
+	}
+	var list []interface{}
+	if existing, ok := doc[field]; ok && existing != nil {
+		if list, ok = existing.([]interface{}); !ok {
+			return fmt.Errorf("field %q of %s/%s is not an array", field, collection, resource)
+		}
+	}
+	doc[field] = append(list, items...)
+
+	if b, err = d.marshalRecord(collection, doc); err != nil {
+		return err
+	}
+	return d.writeRecord(collection, resource, b)
+}
+
+// MergePatch applies an RFC 7386 JSON merge patch to the record: objects in
+// patch are merged recursively into the record, null values delete the
+// corresponding key and every other value replaces what was there. A patch
+// that is not an object replaces the record entirely. The read, patch and
+// write happen under the collection lock. Missing records yield ErrNotFound.
+func (d *Driver) MergePatch(collection, resource string, patch []byte) error {
+	collection, resource = d.normalizeNames(collection, resource)
+	if collection == "" {
+		return fmt.Errorf("Missing collection - no place to save records")
+	}
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to save records (no name)")
+	}
+	var p interface{}
+	if err := d.decodeJSON(patch, &p); err != nil {
+		return fmt.Errorf("invalid merge patch: %v", err)
+	}
+	unlock, err := d.lockCollection(collection)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	b, err := d.readRecord(collection, resource)
+	if os.IsNotExist(err) {
+		return notFound(collection, resource)
+	}
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := d.decodeJSON(b, &doc); err != nil {
+		return fmt.Errorf("record %s/%s is not valid JSON: %v", collection, resource, err)
+	}
+
+	if b, err = d.marshalRecord(collection, mergePatch(doc, p)); err != nil {
+		return err
+	}
+	return d.writeRecord(collection, resource, b)
+}
+
+// mergePatch returns target with patch applied as described in RFC 7386.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = mergePatch(t[key], value)
+		}
+	}
+	return t
+}
+
+// decodeMap decodes a stored record that must be a JSON object.
+func (d *Driver) decodeMap(b []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if err := d.decodeJSON(b, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("record is null")
+	}
+	return doc, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSwapFailureLeavesBothRecords(t *testing.T) {
+	errHook := errors.New("hook failed")
+	failOn := ""
+	d, _ := newTestDriver(t, &Options{
+		WriteHooks: []func(collection, resource string, b []byte) ([]byte, error){
+			func(collection, resource string, b []byte) ([]byte, error) {
+				if resource == failOn {
+					return nil, errHook
+				}
+				return b, nil
+			},
+		},
+	})
+	if err := d.Write("c", "a", "A"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("c", "b", "B"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fail := range []string{"a", "b"} {
+		failOn = fail
+		if err := d.Swap("c", "a", "b"); !errors.Is(err, errHook) {
+			t.Fatalf("Swap failing on %s = %v, want the hook error", fail, err)
+		}
+		var a, b string
+		if err := d.Read("c", "a", &a); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Read("c", "b", &b); err != nil {
+			t.Fatal(err)
+		}
+		if a != "A" || b != "B" {
+			t.Fatalf("after failed swap (write of %s) a=%q b=%q, want A and B", fail, a, b)
+		}
+	}
+
+	failOn = ""
+	if err := d.Swap("c", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	var a, b string
+	d.Read("c", "a", &a)
+	d.Read("c", "b", &b)
+	if a != "B" || b != "A" {
+		t.Fatalf("after swap a=%q b=%q, want B and A", a, b)
+	}
+}
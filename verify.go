@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// VerifyError lists the record files that failed verification, as paths
+// relative to the database directory.
+type VerifyError struct {
+	Corrupt []string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("%d corrupt record(s): %s", len(e.Corrupt), strings.Join(e.Corrupt, ", "))
+}
+
+// Verify checks that every record file of every collection parses with the
+// collection's codec. With Options.VerifySampleSize set, only that many files
+// per collection are checked. Corrupt files are reported together in a
+// *VerifyError.
+func (d *Driver) Verify() error {
+	collections, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	var corrupt []string
+	for _, collection := range collections {
+		files, err := d.recordFiles(collection)
+		if err != nil {
+			return err
+		}
+		if n := d.opts.VerifySampleSize; n > 0 && len(files) > n {
+			files = files[:n]
+		}
+		for _, x := range files {
+			rel, err := filepath.Rel(d.dir, x.path)
+			if err != nil {
+				rel = x.path
+			}
+			b, err := d.readFile(x.path)
+			if err != nil {
+				return err
+			}
+			if b, err = d.loadRecord(collection, x.name, b); err != nil || !d.validRecord(collection, b) {
+				corrupt = append(corrupt, rel)
+			}
+		}
+	}
+	if len(corrupt) > 0 {
+		return &VerifyError{Corrupt: corrupt}
+	}
+	return nil
+}
+
+// validRecord reports whether b parses in the format of collection.
+func (d *Driver) validRecord(collection string, b []byte) bool {
+	if d.isJSON(collection) {
+		return json.Valid(b)
+	}
+	var v interface{}
+	return d.codec(collection).Unmarshal(b, &v) == nil
+}